@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+	"gopkg.in/yaml.v2"
+)
+
+// collinsCredentials are the host and credentials of a Collins instance given
+// on the command line.
+type collinsCredentials struct {
+	Host     string
+	Username string
+	Password string
+}
+
+// isSet returns whether any of the host and credentials is set.
+func (c collinsCredentials) isSet() bool {
+	return c.Host != "" || c.Username != "" || c.Password != ""
+}
+
+// validate returns an error if only part of the host and credentials is set.
+// The error never contains the password.
+func (c collinsCredentials) validate() error {
+	if !c.isSet() {
+		return nil
+	}
+	if c.Host == "" {
+		return errors.New("Collins username or password given without a host")
+	}
+	u, err := url.Parse(c.Host)
+	if err != nil {
+		// The error contains the host, which might contain credentials.
+		return errors.New("invalid Collins host")
+	}
+	if u.User != nil {
+		return fmt.Errorf("Collins host %s must not contain credentials", redactURL(c.Host))
+	}
+	if c.Username == "" || c.Password == "" {
+		return fmt.Errorf("Collins host %s given without username or password", c.Host)
+	}
+	return nil
+}
+
+// String returns the username and host, masking the password.
+func (c collinsCredentials) String() string {
+	return fmt.Sprintf("%s:***@%s", c.Username, redactURL(c.Host))
+}
+
+// redactURL returns s with the password of its user info masked if it is a
+// URL, so that Collins configs and hosts can be logged. Strings that cannot be
+// parsed are masked entirely if they might contain user info.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		if strings.Contains(s, "@") {
+			return "***"
+		}
+		return s
+	}
+	if u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	// url.UserPassword would escape the mask.
+	user := url.User(u.User.Username()).String()
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+user+":***@", 1)
+}
+
+// newCollinsClient creates a client for the Collins instance given by creds
+// if they are set, in which case collinsConfig and profile must be empty.
+// Otherwise, the instance is given by collinsConfig, which is either the path
+// to a Collins config file or an http(s) URL, whose credentials are taken
+// from the COLLINS_USERNAME and COLLINS_PASSWORD environment variables. URLs
+// with user info are rejected, so that credentials do not end up in logs or
+// request parameters. If collinsConfig is empty, the client is configured by the
+// COLLINS_HOST, COLLINS_USERNAME, and COLLINS_PASSWORD environment variables
+// if COLLINS_HOST is set, and by the config file in one of the common
+// locations otherwise. If profile is not empty, config files contain the
+// credentials of several Collins instances, and the ones of the given profile
+// are used, see newCollinsClientFromProfile. The environment variables are
+// then ignored.
+func newCollinsClient(collinsConfig, profile string, creds collinsCredentials) (*collins.Client, error) {
+	if creds.isSet() {
+		if err := creds.validate(); err != nil {
+			return nil, err
+		}
+		if collinsConfig != "" || profile != "" {
+			return nil, errors.New("Collins host and credentials cannot be combined with a Collins config or profile")
+		}
+		return collins.NewClient(creds.Username, creds.Password, creds.Host)
+	}
+	if strings.HasPrefix(collinsConfig, "http://") || strings.HasPrefix(collinsConfig, "https://") {
+		u, err := url.Parse(collinsConfig)
+		if err != nil {
+			// The error contains the URL, which might contain
+			// credentials.
+			return nil, errors.New("invalid Collins URL")
+		}
+		if u.User != nil {
+			return nil, fmt.Errorf("Collins URL %s must not contain credentials, set COLLINS_USERNAME and COLLINS_PASSWORD instead", redactURL(collinsConfig))
+		}
+		user, password := os.Getenv("COLLINS_USERNAME"), os.Getenv("COLLINS_PASSWORD")
+		if user == "" || password == "" {
+			return nil, fmt.Errorf("COLLINS_USERNAME or COLLINS_PASSWORD is not set for Collins URL %s", u)
+		}
+		return collins.NewClient(user, password, u.String())
+	}
+	if profile != "" {
+		if collinsConfig != "" {
+			return newCollinsClientFromProfile(profile, collinsConfig)
+		}
+		return newCollinsClientFromProfile(profile, collinsConfigPaths()...)
+	}
+	if collinsConfig != "" {
+		return collins.NewClientFromFiles(collinsConfig)
+	}
+	if host := os.Getenv("COLLINS_HOST"); host != "" {
+		user, password := os.Getenv("COLLINS_USERNAME"), os.Getenv("COLLINS_PASSWORD")
+		if user == "" || password == "" {
+			return nil, errors.New("COLLINS_HOST is set, but COLLINS_USERNAME or COLLINS_PASSWORD is not")
+		}
+		return collins.NewClient(user, password, host)
+	}
+	return collins.NewClientFromYaml()
+}
+
+// collinsConfigPaths returns the common locations of the Collins config file,
+// in the order collins.NewClientFromYaml searches them.
+func collinsConfigPaths() []string {
+	return []string{
+		os.Getenv("COLLINS_CLIENT_CONFIG"),
+		filepath.Join(os.Getenv("HOME"), ".collins.yml"),
+		"/etc/collins.yml",
+		"/var/db/collins.yml",
+	}
+}
+
+// newCollinsClientFromProfile creates a client from the first of the given
+// config files that exists. Instead of the host and credentials of a single
+// Collins instance, the file maps profile names to them, e.g.:
+//
+//	prod:
+//	  host: https://collins.example.com
+//	  username: exporter
+//	  password: secret
+//	staging:
+//	  ...
+//
+// The host and credentials of the given profile are used.
+func newCollinsClientFromProfile(profile string, paths ...string) (*collins.Client, error) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var profiles map[string]struct {
+			Host     string
+			Username string
+			Password string
+		}
+		if err := yaml.Unmarshal(data, &profiles); err != nil {
+			return nil, fmt.Errorf("could not parse Collins config %s: %s", path, err)
+		}
+		creds, ok := profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("no profile %q in Collins config %s", profile, path)
+		}
+		return collins.NewClient(creds.Username, creds.Password, creds.Host)
+	}
+	return nil, fmt.Errorf("could not load Collins config (searched: %s)", strings.Join(paths, ", "))
+}
+
+// The defaults of the connection pool of the transport used for requests to
+// Collins. The exporter talks to a single Collins host with several concurrent
+// requests, e.g. for pages, hardware, and power status, so that the two idle
+// connections per host kept by http.DefaultTransport result in connection
+// churn.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 50
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// transportConfig contains the settings of the transport used for requests to
+// Collins.
+type transportConfig struct {
+	// Namespace is the prefix of the names of the metrics instrumenting
+	// the requests.
+	Namespace string
+	// Timeout limits the duration of each request. If zero, requests have
+	// no timeout.
+	Timeout time.Duration
+	// CAFile is the path to a PEM file with the CA certificates used to
+	// verify the certificate of Collins. If empty, the system CAs are used.
+	CAFile string
+	// InsecureSkipVerify disables the verification of the certificate of
+	// Collins.
+	InsecureSkipVerify bool
+	// RateLimit is the maximum number of requests to Collins per second. If
+	// zero, requests are not limited.
+	RateLimit float64
+	// UserAgent replaces the User-Agent header of go-collins. If empty,
+	// the header is left as is.
+	UserAgent string
+	// MaxIdleConns is the maximum number of idle connections kept for
+	// reuse. If zero, defaultMaxIdleConns is used.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept
+	// for reuse per host. If zero, defaultMaxIdleConnsPerHost is used.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is the time after which idle connections are closed.
+	// If zero, defaultIdleConnTimeout is used.
+	IdleConnTimeout time.Duration
+}
+
+// setupCollinsTransport returns the transport for requests to Collins, see
+// Config.Transport. It is based on a clone of http.DefaultTransport, which is
+// left untouched. The metrics instrumenting the requests are registered with
+// reg.
+func setupCollinsTransport(config transportConfig, reg prometheus.Registerer) (http.RoundTripper, error) {
+	defaultTransport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unexpected type of http.DefaultTransport")
+	}
+	transport := defaultTransport.Clone()
+	if config.CAFile != "" || config.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+		if config.CAFile != "" {
+			pem, err := ioutil.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+			}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = defaultMaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	// Keep-alives allow reusing connections across requests. A custom
+	// TLSClientConfig disables HTTP/2 unless it is forced.
+	transport.DisableKeepAlives = false
+	transport.ForceAttemptHTTP2 = true
+	var next http.RoundTripper = transport
+	if config.UserAgent != "" {
+		next = &userAgentTransport{
+			next:      next,
+			userAgent: config.UserAgent,
+		}
+	}
+	if config.Timeout > 0 {
+		next = &timeoutTransport{
+			next:    next,
+			timeout: config.Timeout,
+		}
+	}
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: config.Namespace,
+		Subsystem: "client",
+		Name:      "requests_total",
+		Help:      "Total number of requests to Collins by status code and method.",
+	}, []string{"code", "method"})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: config.Namespace,
+		Subsystem: "client",
+		Name:      "request_duration_seconds",
+		Help:      "Histogram of the durations of requests to Collins until the response headers were received.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"code", "method"})
+	if err := reg.Register(requests); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(durations); err != nil {
+		return nil, err
+	}
+	next = promhttp.InstrumentRoundTripperCounter(requests,
+		promhttp.InstrumentRoundTripperDuration(durations, next),
+	)
+
+	limited := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: config.Namespace,
+		Name:      "rate_limited_total",
+		Help:      "Total number of requests to Collins delayed by the rate limit.",
+	})
+	if err := reg.Register(limited); err != nil {
+		return nil, err
+	}
+	// The rate limit is applied outermost, so that the time waiting for it
+	// counts neither towards the request duration nor the timeout.
+	if config.RateLimit > 0 {
+		next = &rateLimitTransport{
+			next:     next,
+			interval: time.Duration(float64(time.Second) / config.RateLimit),
+			limited:  limited,
+		}
+	}
+	return next, nil
+}
+
+// setHTTPClient makes c send its requests with hc. go-collins does not allow
+// setting the http.Client of a collins.Client, as the field holding it is
+// unexported, so it is set through reflection.
+func setHTTPClient(c *collins.Client, hc *http.Client) error {
+	field := reflect.ValueOf(c).Elem().FieldByName("client")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(hc) {
+		return errors.New("unexpected type of collins.Client")
+	}
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(hc))
+	return nil
+}
+
+// timeoutTransport is an http.RoundTripper that limits the duration of each
+// request, including reading the response body, to the given timeout.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// rateLimitTransport is an http.RoundTripper that starts at most one request
+// per interval, delaying requests as needed.
+type rateLimitTransport struct {
+	next     http.RoundTripper
+	interval time.Duration
+	limited  prometheus.Counter
+
+	mtx      sync.Mutex
+	nextSlot time.Time
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mtx.Lock()
+	now := time.Now()
+	if t.nextSlot.Before(now) {
+		t.nextSlot = now
+	}
+	wait := t.nextSlot.Sub(now)
+	t.nextSlot = t.nextSlot.Add(t.interval)
+	t.mtx.Unlock()
+
+	if wait > 0 {
+		t.limited.Inc()
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// userAgentTransport is an http.RoundTripper that sets the User-Agent header
+// of each request.
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+// defaultUserAgent returns the default User-Agent header of the requests to
+// Collins. The version is unknown if it was not set at build time.
+func defaultUserAgent() string {
+	v := version.Version
+	if v == "" {
+		v = "unknown"
+	}
+	return "collins_exporter/" + v
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// cancelOnClose releases the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
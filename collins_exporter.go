@@ -1,18 +1,79 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+	"github.com/schallert/iso8601"
 	"gopkg.in/tumblr/go-collins.v0/collins"
 )
 
-const namespace = "collins"
+const (
+	// defaultNamespace is the prefix of all metric names if no other
+	// namespace is configured.
+	defaultNamespace = "collins"
+
+	// defaultAssetType is the type of the assets exported if neither a
+	// query nor an asset type is configured.
+	defaultAssetType = "SERVER_NODE"
+
+	// paginationPage and paginationCursor are the pagination modes of the
+	// retrieval of the assets. See Config.PaginationMode.
+	paginationPage   = "page"
+	paginationCursor = "cursor"
+)
+
+// defaultScrapeDurationBuckets are the buckets of the scrape duration
+// histogram if none are configured. Scrapes of large inventories take several
+// seconds up to minutes.
+var defaultScrapeDurationBuckets = []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// defaultScrapeDurationSmoothing is the default weight of the latest scrape
+// duration in the exponential moving average of the scrape durations.
+const defaultScrapeDurationSmoothing = 0.2
+
+// assetTypes lists the asset types known to Collins.
+var assetTypes = []string{
+	"SERVER_NODE",
+	"SERVER_CHASSIS",
+	"RACK",
+	"SWITCH",
+	"ROUTER",
+	"POWER_CIRCUIT",
+	"POWER_STRIP",
+	"DATA_CENTER",
+	"CONFIGURATION",
+}
+
+// redactedIPMIAddress replaces IPMI addresses in labels if they are redacted.
+const redactedIPMIAddress = "redacted"
+
+// attributeSeriesWarnThreshold is the number of series of the attributes
+// metric above which a warning is logged if no whitelist is configured.
+const attributeSeriesWarnThreshold = 100000
 
 // statusNames lists the possible Collins status strings for an asset.
 var statusNames = []string{
@@ -27,119 +88,1206 @@ var statusNames = []string{
 	"Maintenance",    // Asset is undergoing some kind of maintenance and should not be considered for production use.
 }
 
+// Config contains the settings an Exporter is created with.
+type Config struct {
+	// Namespace is the prefix of all metric names. If empty,
+	// defaultNamespace is used.
+	Namespace string
+	// CollinsConfig is the path to the Collins config file. If empty, the
+	// common locations are searched.
+	CollinsConfig string
+	// Profile selects the Collins instance from Collins config files with
+	// several profiles. If empty, config files describe a single instance.
+	Profile string
+	// Credentials are the host and credentials of the Collins instance
+	// given on the command line. If set, they are used instead of a Collins
+	// config, so CollinsConfig and Profile must be empty.
+	Credentials collinsCredentials
+	// Query is the CQL query selecting the assets to export. If empty, it is
+	// built from AssetType, IncludeStatuses, and ExcludeStatuses.
+	Query string
+	// FlagQuery is a CQL query selecting the assets to flag among those
+	// exported. If empty, no assets are flagged.
+	FlagQuery string
+	// AssetType is the type of the assets to export if Query is empty. If
+	// empty, defaultAssetType is used.
+	AssetType string
+	// IncludeStatuses are the statuses of the assets to export if Query is
+	// empty. If empty, assets of all statuses except Incomplete are
+	// exported.
+	IncludeStatuses []string
+	// ExcludeStatuses are statuses of assets not to export if Query is
+	// empty.
+	ExcludeStatuses []string
+	// CollectHardware enables retrieving the detailed representation of
+	// each asset to export hardware metrics.
+	CollectHardware bool
+	// HardwareConcurrency is the maximum number of concurrent requests
+	// retrieving the hardware of assets.
+	HardwareConcurrency int
+	// CollectPower enables querying the power status of each asset.
+	CollectPower bool
+	// PowerConcurrency is the maximum number of concurrent power status
+	// queries.
+	PowerConcurrency int
+	// CollectLogs enables retrieving the most recent logs of each asset to
+	// export the number of logs per severity.
+	CollectLogs bool
+	// LogLimit is the maximum number of logs retrieved per asset.
+	LogLimit int
+	// LogMaxAge is the maximum age of the logs considered. If zero, all
+	// logs retrieved are considered.
+	LogMaxAge time.Duration
+	// LogConcurrency is the maximum number of concurrent requests
+	// retrieving the logs of assets.
+	LogConcurrency int
+	// PowerWattsAttribute is the key of the Collins attribute holding the
+	// power draw of an asset in watts. If empty, the power draw is not
+	// exported.
+	PowerWattsAttribute string
+	// PrimaryAddressPool is the Collins address pool of the address
+	// exported as the primary address of an asset. If empty, or if an
+	// asset has no address in the pool, its first address is used.
+	PrimaryAddressPool string
+	// ProbeIPMI enables checking whether the IPMI address of each asset
+	// accepts TCP connections on IPMIProbePort.
+	ProbeIPMI bool
+	// IPMIProbePort is the TCP port probed on IPMI addresses.
+	IPMIProbePort int
+	// IPMIProbeTimeout is the time after which an IPMI probe fails.
+	IPMIProbeTimeout time.Duration
+	// IPMIProbeConcurrency is the maximum number of concurrent IPMI probes.
+	IPMIProbeConcurrency int
+	// Endpoint identifies the Collins instance scraped. If not empty, it is
+	// added as the endpoint label to all metrics.
+	Endpoint string
+	// DetailAttributes are the keys of the Collins attributes added as
+	// labels to the details metric.
+	DetailAttributes []string
+	// NumericAttributes are the Collins attributes exported as metrics, each
+	// given as KEY=name, resulting in the metric asset_attr_<name>. If the
+	// name is omitted, the lowercased key is used.
+	NumericAttributes []string
+	// RedactIPMI enables replacing the IPMI addresses in the ipmi_address
+	// label of the details metric by redactedIPMIAddress.
+	RedactIPMI bool
+	// ExportAttributes enables exporting the Collins attributes of each
+	// asset in the key and value labels of the attributes metric.
+	ExportAttributes bool
+	// AttributeWhitelist are the keys of the Collins attributes exported
+	// if ExportAttributes is set, in any case. If empty, all attributes are
+	// exported.
+	AttributeWhitelist []string
+	// ExportTypeLabel enables adding the type label with the asset type to
+	// the status, state, and details metrics.
+	ExportTypeLabel bool
+	// LowercaseTags enables lowercasing the tag label of all asset
+	// metrics.
+	LowercaseTags bool
+	// StateAgeStatuses are the statuses for which the time since the last
+	// update of an asset is exported. As assets are expected to leave
+	// these statuses soon, the time tells how long an asset is stuck.
+	StateAgeStatuses []string
+	// UseAssetTimestamps enables attaching the time of the last update of
+	// each asset in Collins to its metrics instead of leaving the time to
+	// the scraper.
+	UseAssetTimestamps bool
+	// IntakeStatuses are the statuses of assets going through intake, for
+	// which the time since the creation of an asset and the number of
+	// assets per status are exported.
+	IntakeStatuses []string
+	// TagAllow are the patterns of the tags of the assets exported. If
+	// empty, all assets not matching TagDeny are exported.
+	TagAllow []*regexp.Regexp
+	// TagDeny are the patterns of the tags of the assets not exported. They
+	// take precedence over TagAllow.
+	TagDeny []*regexp.Regexp
+	// MaxAssets is the maximum number of assets retrieved per scrape. Further
+	// assets are ignored. If zero, all assets are retrieved.
+	MaxAssets int
+	// PageSize is the number of assets retrieved from Collins per request.
+	PageSize int
+	// Transport is the transport of the requests to Collins, see
+	// setupCollinsTransport. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// PaginationMode is how the assets are retrieved page by page. In
+	// "page" mode, the pages are requested by their number, concurrently.
+	// In "cursor" mode, the first page of the assets following the last
+	// asset retrieved so far is requested, one page after the other. If
+	// empty, "page" mode is used.
+	PaginationMode string
+	// Retries is the number of times a failed asset page request is
+	// retried.
+	Retries int
+	// Concurrency is the maximum number of asset pages retrieved from
+	// Collins at the same time.
+	Concurrency int
+	// ScrapeInterval is the interval in which Collins is scraped
+	// independently of scrapes of the exporter. If zero, Collins is
+	// scraped on demand.
+	ScrapeInterval time.Duration
+	// ScrapeJitter is the maximum random delay of the first scrape if a
+	// ScrapeInterval is set, so that several exporters started at the same
+	// time do not scrape Collins at the same time. It must not exceed
+	// ScrapeInterval.
+	ScrapeJitter time.Duration
+	// WarmUp enables scraping Collins upon start of Loop if no
+	// ScrapeInterval is set, so that the first scrape of the exporter does
+	// not pay the full latency of a Collins scrape.
+	WarmUp bool
+	// CacheTTL is the time for which the result of a Collins scrape is
+	// served without scraping Collins again. If zero, every scrape of the
+	// exporter results in a scrape of Collins.
+	CacheTTL time.Duration
+	// Incremental enables only requesting the assets updated since the
+	// last successful scrape and merging them into the assets retained
+	// from earlier scrapes. Assets no longer matching the query are only
+	// dropped by the full scrapes in FullRefreshInterval.
+	Incremental bool
+	// FullRefreshInterval is the interval in which Collins is scraped in
+	// full if Incremental is set. It must be positive then.
+	FullRefreshInterval time.Duration
+	// AllowPartial enables exporting the assets retrieved by a scrape that
+	// failed to retrieve all assets.
+	AllowPartial bool
+	// BreakerThreshold is the number of consecutive failed scrapes after
+	// which Collins is not scraped for BreakerCooldown. If zero, Collins
+	// is always scraped.
+	BreakerThreshold int
+	// BreakerCooldown is the time for which Collins is not scraped once
+	// BreakerThreshold is reached.
+	BreakerCooldown time.Duration
+	// ScrapeTimeout is the time after which a Collins scrape is abandoned
+	// and counted as failed. If zero, scrapes run until completion.
+	ScrapeTimeout time.Duration
+	// StateRefreshInterval is the interval in which the list of Collins
+	// states is refreshed.
+	StateRefreshInterval time.Duration
+	// ScrapeDurationBuckets are the buckets of the scrape duration
+	// histogram. If empty, defaultScrapeDurationBuckets are used.
+	ScrapeDurationBuckets []float64
+	// ScrapeDurationSmoothing is the weight of the latest scrape duration
+	// in the exponential moving average of the scrape durations. It must
+	// be in (0, 1]. If zero, defaultScrapeDurationSmoothing is used.
+	ScrapeDurationSmoothing float64
+}
+
+// AssetFinder finds the Collins assets matching the given options. The Assets
+// service of collins.Client implements it.
+type AssetFinder interface {
+	Find(opts *collins.AssetFindOpts) ([]collins.Asset, *collins.Response, error)
+}
+
 // Exporter collects Collins stats from the given endpoint and exports them
 // via the prometheus.Collector interface.
 type Exporter struct {
-	client *collins.Client
+	config Config
+
+	// client, finder, lastScrapeResult, lastScrapeAttributes,
+	// lastScrapeEnd, states, statesUpdated, consecutiveFailures,
+	// breakerOpenUntil, statuses, statusTransitions,
+	// scrapeDurationAverage, retainedAssets, lastFullRefresh, and
+	// updatedSince are owned by the scrape in progress. Loop
+	// runs at most one scrapeCollins at a time and only reads
+	// lastScrapeResult, lastScrapeAttributes, and lastScrapeEnd while none
+	// is running. No other goroutine may access them, except for those
+	// started by scrapeCollins, which finish before it returns. Collect
+	// sends a channel via requests and receives lastScrapeResult and
+	// lastScrapeAttributes on it. As scrapeCollins always creates a new
+	// slice and map, a result is never modified once handed out.
+	client               *collins.Client
+	finder               AssetFinder
+	lastScrapeResult     []prometheus.Metric
+	lastScrapeAttributes map[string]map[string]string
+	lastScrapeEnd        time.Time
+	states               []collins.State
+	statesUpdated        time.Time
+
+	consecutiveFailures int
+	breakerOpenUntil    time.Time
+
+	// statuses maps the tags of the assets of the last successful scrape
+	// to their status, and statusTransitions to the number of their
+	// status changes observed.
+	statuses          map[string]string
+	statusTransitions map[string]int
 
-	lastScrapeResult []prometheus.Metric
-	requestScrape    chan struct{}
-	scrapeResult     chan []prometheus.Metric
+	// scrapeDurationAverage is the exponential moving average of the
+	// scrape durations in seconds.
+	scrapeDurationAverage float64
 
-	up, scrapeDuration           prometheus.Gauge
-	scrapesTotal, scrapeFailures prometheus.Counter
+	// retainedAssets maps the tags of the assets retrieved in incremental
+	// mode to the latest data of the asset. lastFullRefresh is the start
+	// of the last successful full scrape, and updatedSince that of the
+	// last successful scrape, incremental or not.
+	retainedAssets  map[string]collins.Asset
+	lastFullRefresh time.Time
+	updatedSince    time.Time
+
+	requests chan chan scrapeResult
+
+	// lastSuccess is the time the last successful scrape of Collins ended,
+	// or the zero time if the last scrape failed. It is read by the
+	// readiness handler and thus protected by mtx. reloadedClient is set by
+	// SwapClient and swapped in by the next scrape, also under mtx.
+	mtx            sync.Mutex
+	lastSuccess    time.Time
+	reloadedClient *collins.Client
+
+	up, scrapeDuration, lastScrapeTimestamp prometheus.Gauge
+	scrapeDurationEMA                       prometheus.Gauge
+	lastSuccessTimestamp                    prometheus.Gauge
+	scrapeComplete, circuitOpen             prometheus.Gauge
+	scrapeInProgress, assetsScraped         prometheus.Gauge
+	collectWaiters                          prometheus.Gauge
+	scrapePages, assetsTruncated            prometheus.Gauge
+	partialScrapes, failedPages             prometheus.Counter
+	scrapesTotal, scrapeFailures            prometheus.Counter
+	scrapesSkipped                          prometheus.Counter
+	scrapeRetries, hardwareFailures         prometheus.Counter
+	duplicateTags                           prometheus.Counter
+	scrapeError                             *prometheus.GaugeVec
+	scrapeDurations, pageDurations          prometheus.Histogram
 
 	assetStatusDesc, assetStateDesc, assetDetailsDesc *prometheus.Desc
+	assetStateInfoDesc                                *prometheus.Desc
+	assetCreatedDesc, assetUpdatedDesc                *prometheus.Desc
+	assetCPUCoresDesc, assetCPUThreadsDesc            *prometheus.Desc
+	assetMemoryBytesDesc, assetPowerOnDesc            *prometheus.Desc
+	assetsByStatusDesc                                *prometheus.Desc
+	assetPoolInfoDesc                                 *prometheus.Desc
+	assetDiskCountDesc                                *prometheus.Desc
+	assetDiskCapacityDesc                             *prometheus.Desc
+	assetsByNodeclassDesc                             *prometheus.Desc
+	assetsByDatacenterDesc                            *prometheus.Desc
+	assetIPMIReachableDesc                            *prometheus.Desc
+	tagsTotalDesc                                     *prometheus.Desc
+	stateInfoDesc                                     *prometheus.Desc
+	assetStateAgeDesc                                 *prometheus.Desc
+	assetIPMIConfiguredDesc                           *prometheus.Desc
+	assetAddressInfoDesc                              *prometheus.Desc
+	serverInfoDesc                                    *prometheus.Desc
+	assetAddressCountDesc                             *prometheus.Desc
+	assetHostnameInfoDesc                             *prometheus.Desc
+	assetLogSeverityDesc                              *prometheus.Desc
+	assetPowerWattsDesc                               *prometheus.Desc
+	assetInMaintenanceDesc                            *prometheus.Desc
+	assetStatusTransitionsDesc                        *prometheus.Desc
+	assetMissingNodeclassDesc                         *prometheus.Desc
+	assetsMissingNodeclassDesc                        *prometheus.Desc
+	assetsUnknownStatusDesc                           *prometheus.Desc
+	assetAttributesDesc                               *prometheus.Desc
+	assetProvisionInfoDesc                            *prometheus.Desc
+	assetIntakeAgeDesc, intakeBacklogDesc             *prometheus.Desc
+	assetFlaggedDesc                                  *prometheus.Desc
+	assetUnknownStatusDesc                            *prometheus.Desc
+	assetLinkInfoDesc                                 *prometheus.Desc
+
+	numericAttributes []numericAttribute
+
+	// queryInfo exports the query, which is part of the config and thus
+	// constant.
+	queryInfo prometheus.Metric
+}
+
+// numericAttribute is a Collins attribute exported as a metric.
+type numericAttribute struct {
+	key  string
+	desc *prometheus.Desc
 }
 
-func newCollinsClient(collinsConfig string) (*collins.Client, error) {
-	if collinsConfig != "" {
-		return collins.NewClientFromFiles(collinsConfig)
+// NewExporter returns an Exporter initialized with the given config. It returns
+// an error if the config is invalid.
+func NewExporter(config Config) (*Exporter, error) {
+	e, err := NewExporterWithFinder(config, nil)
+	if err != nil {
+		return nil, err
 	}
-	return collins.NewClientFromYaml()
+	// If the client cannot be set up now, scrapeCollins will try again.
+	e.setupClient()
+	return e, nil
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(collinsConfig string) *Exporter {
+// NewExporterWithFinder returns an Exporter initialized with the given config
+// that retrieves assets from finder. If finder is nil, a Collins client is set
+// up from the config on the first scrape. Otherwise, no Collins client is set
+// up, and the hardware, power, logs, tags, states, and server information is
+// not retrieved. It returns an error if the config is invalid.
+func NewExporterWithFinder(config Config, finder AssetFinder) (*Exporter, error) {
+	if config.PageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive, got %d", config.PageSize)
+	}
+	if err := config.Credentials.validate(); err != nil {
+		return nil, err
+	}
+	if config.Credentials.isSet() && (config.CollinsConfig != "" || config.Profile != "") {
+		return nil, errors.New("Collins host and credentials cannot be combined with a Collins config or profile")
+	}
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	if !validNamespace(namespace) {
+		return nil, fmt.Errorf("invalid metric namespace %q", namespace)
+	}
+	var constLabels prometheus.Labels
+	if config.Endpoint != "" {
+		constLabels = prometheus.Labels{"endpoint": config.Endpoint}
+	}
+
+	statusLabels := []string{"tag", "status"}
+	stateLabels := []string{"tag"}
+	detailLabels := []string{"tag", "nodeclass", "ipmi_address", "primary_address"}
+	if config.ExportTypeLabel {
+		statusLabels = append(statusLabels, "type")
+		stateLabels = append(stateLabels, "type")
+		detailLabels = append(detailLabels, "type")
+	}
+	for _, key := range config.DetailAttributes {
+		name, err := sanitizeLabelName(key)
+		if err != nil {
+			return nil, err
+		}
+		inUse := constLabels[name] != ""
+		for _, l := range detailLabels {
+			inUse = inUse || l == name
+		}
+		if inUse {
+			return nil, fmt.Errorf("label name %q for attribute %q is already in use", name, key)
+		}
+		detailLabels = append(detailLabels, name)
+	}
 
-	client, err := newCollinsClient(collinsConfig)
-	if err != nil {
-		log.Errorf("Could not set up collins client: %s", err)
+	var numericAttributes []numericAttribute
+	metricNames := map[string]bool{}
+	for _, attr := range config.NumericAttributes {
+		key, name := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			key, name = attr[:i], attr[i+1:]
+		} else {
+			name = strings.ToLower(key)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty attribute key in %q", attr)
+		}
+		// Colons in metric names are reserved for recording rules.
+		if name == "" || strings.Contains(name, ":") || !validNamespace("attr_"+name) {
+			return nil, fmt.Errorf("invalid metric name %q for attribute %q", name, key)
+		}
+		fqName := prometheus.BuildFQName(namespace, "asset", "attr_"+name)
+		if metricNames[fqName] {
+			return nil, fmt.Errorf("metric name %q for attribute %q is already in use", fqName, key)
+		}
+		metricNames[fqName] = true
+		numericAttributes = append(numericAttributes, numericAttribute{
+			key: key,
+			desc: prometheus.NewDesc(
+				fqName,
+				fmt.Sprintf("The value of the Collins attribute %s of the asset with the given tag.", strings.ToUpper(key)),
+				[]string{"tag"},
+				constLabels,
+			),
+		})
+	}
+
+	if config.Query == "" {
+		query, err := assetQuery(config.AssetType, config.IncludeStatuses, config.ExcludeStatuses)
+		if err != nil {
+			return nil, err
+		}
+		config.Query = query
+	} else if config.AssetType != "" {
+		return nil, fmt.Errorf("asset type %q cannot be combined with a query", config.AssetType)
+	} else if len(config.IncludeStatuses) > 0 || len(config.ExcludeStatuses) > 0 {
+		return nil, errors.New("included or excluded statuses cannot be combined with a query")
+	}
+	if len(config.ScrapeDurationBuckets) == 0 {
+		config.ScrapeDurationBuckets = defaultScrapeDurationBuckets
+	}
+	if config.ScrapeDurationSmoothing == 0 {
+		config.ScrapeDurationSmoothing = defaultScrapeDurationSmoothing
+	}
+	if config.Incremental && config.FullRefreshInterval <= 0 {
+		return nil, fmt.Errorf("full refresh interval %v must be positive in incremental mode", config.FullRefreshInterval)
+	}
+	if config.ScrapeDurationSmoothing < 0 || config.ScrapeDurationSmoothing > 1 {
+		return nil, fmt.Errorf("scrape duration smoothing %v must be in (0, 1]", config.ScrapeDurationSmoothing)
+	}
+	// Each whitelisted attribute results in one series per asset, so the
+	// keys must be unique regardless of their case.
+	whitelist := make([]string, 0, len(config.AttributeWhitelist))
+	whitelisted := map[string]bool{}
+	for _, key := range config.AttributeWhitelist {
+		key = strings.ToUpper(key)
+		if !whitelisted[key] {
+			whitelisted[key] = true
+			whitelist = append(whitelist, key)
+		}
+	}
+	config.AttributeWhitelist = whitelist
+	// The backlog metric has one series per intake status, so the statuses
+	// must be known and unique.
+	intakeStatuses := make([]string, 0, len(config.IntakeStatuses))
+	intake := map[string]bool{}
+	for _, status := range config.IntakeStatuses {
+		name, err := statusName(status)
+		if err != nil {
+			return nil, err
+		}
+		if !intake[name] {
+			intake[name] = true
+			intakeStatuses = append(intakeStatuses, name)
+		}
+	}
+	config.IntakeStatuses = intakeStatuses
+	// Likewise, a status given twice would result in duplicate series of the
+	// state age metric.
+	stateAgeStatuses := make([]string, 0, len(config.StateAgeStatuses))
+	stateAge := map[string]bool{}
+	for _, status := range config.StateAgeStatuses {
+		name, err := statusName(status)
+		if err != nil {
+			return nil, err
+		}
+		if !stateAge[name] {
+			stateAge[name] = true
+			stateAgeStatuses = append(stateAgeStatuses, name)
+		}
+	}
+	config.StateAgeStatuses = stateAgeStatuses
+	if config.MaxAssets < 0 {
+		return nil, fmt.Errorf("maximum number of assets must not be negative, got %d", config.MaxAssets)
+	}
+	switch config.PaginationMode {
+	case "":
+		config.PaginationMode = paginationPage
+	case paginationPage, paginationCursor:
+	default:
+		return nil, fmt.Errorf("invalid pagination mode %q, must be %q or %q", config.PaginationMode, paginationPage, paginationCursor)
+	}
+	if config.ScrapeJitter > config.ScrapeInterval {
+		return nil, fmt.Errorf("scrape jitter %v exceeds the scrape interval %v", config.ScrapeJitter, config.ScrapeInterval)
+	}
+	if config.HardwareConcurrency < 1 {
+		config.HardwareConcurrency = 1
+	}
+	if config.PowerConcurrency < 1 {
+		config.PowerConcurrency = 1
+	}
+	if config.LogLimit < 1 {
+		config.LogLimit = 1
+	}
+	if config.LogConcurrency < 1 {
+		config.LogConcurrency = 1
+	}
+	if config.IPMIProbeConcurrency < 1 {
+		config.IPMIProbeConcurrency = 1
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
 	}
 
-	return &Exporter{
-		client:        client,
-		requestScrape: make(chan struct{}),
-		scrapeResult:  make(chan []prometheus.Metric),
+	e := &Exporter{
+		finder:   finder,
+		config:   config,
+		requests: make(chan chan scrapeResult),
+
+		queryInfo: prometheus.MustNewConstMetric(
+			prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "", "query_info"),
+				"Constant metric with value '1' providing the CQL query selecting the assets.",
+				[]string{"query"},
+				constLabels,
+			),
+			prometheus.GaugeValue,
+			1,
+			config.Query,
+		),
+
+		statuses:          map[string]string{},
+		statusTransitions: map[string]int{},
+
+		numericAttributes: numericAttributes,
 
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "'1' if the last scrape of Collins was successful, '0' otherwise.",
+			Namespace:   namespace,
+			Name:        "up",
+			Help:        "'1' if the last scrape of Collins was successful, '0' otherwise.",
+			ConstLabels: constLabels,
+		}),
+		scrapeComplete: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_complete",
+			Help:        "'1' if the last scrape of Collins retrieved all assets, '0' otherwise.",
+			ConstLabels: constLabels,
+		}),
+		assetsScraped: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "assets_scraped",
+			Help:        "Number of assets retrieved by the last successful scrape of Collins.",
+			ConstLabels: constLabels,
+		}),
+		assetsTruncated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "assets_truncated",
+			Help:        "'1' if the last scrape of Collins ignored assets beyond the maximum number of assets, '0' otherwise.",
+			ConstLabels: constLabels,
+		}),
+		scrapePages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_pages",
+			Help:        "Number of pages of assets retrieved by the last scrape of Collins.",
+			ConstLabels: constLabels,
+		}),
+		scrapeInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_in_progress",
+			Help:        "'1' if a scrape of Collins is in progress, '0' otherwise.",
+			ConstLabels: constLabels,
+		}),
+		collectWaiters: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "collect_waiters",
+			Help:        "Number of collections of the asset metrics currently waiting for the result of a scrape of Collins.",
+			ConstLabels: constLabels,
+		}),
+		circuitOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "circuit_open",
+			Help:        "'1' if Collins is not scraped because of too many consecutive failures, '0' otherwise.",
+			ConstLabels: constLabels,
+		}),
+		partialScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "partial_scrapes_total",
+			Help:        "Total number of Collins scrapes exporting only part of the assets.",
+			ConstLabels: constLabels,
+		}),
+		failedPages: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "failed_pages_total",
+			Help:        "Total number of pages of assets that could not be retrieved from Collins, even after retries.",
+			ConstLabels: constLabels,
 		}),
 		scrapeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "scrape_duration_seconds",
-			Help:      "The duration it took to scrape Collins.",
+			Namespace:   namespace,
+			Name:        "scrape_duration_seconds",
+			Help:        "The duration it took to scrape Collins the last time.",
+			ConstLabels: constLabels,
+		}),
+		scrapeDurationEMA: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_duration_ema_seconds",
+			Help:        "Exponential moving average of the durations it took to scrape Collins.",
+			ConstLabels: constLabels,
+		}),
+		scrapeDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "scrape_latency_seconds",
+			Help:        "Histogram of the durations it took to scrape Collins.",
+			Buckets:     config.ScrapeDurationBuckets,
+			ConstLabels: constLabels,
+		}),
+		lastScrapeTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_scrape_timestamp_seconds",
+			Help:        "The Unix timestamp of the end of the last scrape of Collins.",
+			ConstLabels: constLabels,
+		}),
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_successful_scrape_timestamp_seconds",
+			Help:        "The Unix timestamp of the end of the last successful scrape of Collins.",
+			ConstLabels: constLabels,
+		}),
+		pageDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "scrape_page_duration_seconds",
+			Help:        "Histogram of the durations of requests for a page of assets.",
+			Buckets:     prometheus.ExponentialBuckets(0.05, 2, 12),
+			ConstLabels: constLabels,
 		}),
 		scrapesTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "scrapes_total",
-			Help:      "Total number of Collins scrapes.",
+			Namespace:   namespace,
+			Name:        "scrapes_total",
+			Help:        "Total number of Collins scrapes.",
+			ConstLabels: constLabels,
 		}),
 		scrapeFailures: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "scrape_failures_total",
-			Help:      "Total number of failures scraping Collins.",
+			Namespace:   namespace,
+			Name:        "scrape_failures_total",
+			Help:        "Total number of failures scraping Collins.",
+			ConstLabels: constLabels,
+		}),
+		scrapesSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrapes_skipped_total",
+			Help:        "Total number of Collins scrapes skipped because the circuit breaker was open.",
+			ConstLabels: constLabels,
+		}),
+		scrapeRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrape_retries_total",
+			Help:        "Total number of retried requests while scraping Collins.",
+			ConstLabels: constLabels,
+		}),
+		scrapeError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "scrape_error",
+			Help:        "'1' if the last scrape of Collins failed for the given reason, '0' otherwise.",
+			ConstLabels: constLabels,
+		}, []string{"reason"}),
+		duplicateTags: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "duplicate_tags_total",
+			Help:        "Total number of assets not exported because a preceding asset of the same scrape had the same tag.",
+			ConstLabels: constLabels,
+		}),
+		hardwareFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "hardware_fetch_failures_total",
+			Help:        "Total number of failures retrieving the hardware of an asset.",
+			ConstLabels: constLabels,
 		}),
 		assetStatusDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "asset", "status"),
 			"'1' if the asset with the given tag has the given Collins status, '0' otherwise.",
-			[]string{"tag", "status"},
-			nil,
+			statusLabels,
+			constLabels,
 		),
 		assetStateDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "asset", "state"),
 			"The numerical Collins state ID for the asset with the given tag.",
+			stateLabels,
+			constLabels,
+		),
+		assetStateInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "state_info"),
+			"Constant metric with value '1' providing the Collins state name and label for the asset with the given tag.",
+			[]string{"tag", "state_name", "state_label"},
+			constLabels,
+		),
+		assetCreatedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "created_timestamp_seconds"),
+			"The Unix timestamp of the creation of the asset with the given tag in Collins.",
 			[]string{"tag"},
-			nil,
+			constLabels,
+		),
+		assetUpdatedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "updated_timestamp_seconds"),
+			"The Unix timestamp of the last update of the asset with the given tag in Collins.",
+			[]string{"tag"},
+			constLabels,
 		),
 		assetDetailsDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "asset", "details"),
 			"Constant metric with value '1' providing details for the asset with the given tag as labels.",
-			[]string{"tag", "nodeclass", "ipmi_address", "primary_address"},
+			detailLabels,
+			constLabels,
+		),
+		assetCPUCoresDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "cpu_cores"),
+			"The total number of CPU cores across all sockets of the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetCPUThreadsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "cpu_threads"),
+			"The total number of CPU threads across all sockets of the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetMemoryBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "memory_bytes"),
+			"The total physical memory installed in the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetPowerOnDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "power_on"),
+			"'1' if the asset with the given tag is powered on, '0' if it is powered off.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetsByStatusDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "assets_by_status"),
+			"The number of assets with the given Collins status.",
+			[]string{"status"},
+			constLabels,
+		),
+		assetPoolInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "pool_info"),
+			"Constant metric with value '1' providing the Collins pool of the asset with the given tag.",
+			[]string{"tag", "pool"},
+			constLabels,
+		),
+		assetDiskCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "disk_count"),
+			"The number of disks installed in the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetDiskCapacityDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "disk_capacity_bytes"),
+			"The total capacity of the disks installed in the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetsByNodeclassDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "assets_by_nodeclass"),
+			"The number of assets with the given nodeclass.",
+			[]string{"nodeclass"},
+			constLabels,
+		),
+		assetsByDatacenterDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "assets_by_datacenter"),
+			"The number of assets in the given datacenter according to their DATACENTER attribute, or 'unknown' if they have none.",
+			[]string{"datacenter"},
+			constLabels,
+		),
+		assetIPMIReachableDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "ipmi_reachable"),
+			"'1' if the IPMI address of the asset with the given tag accepts TCP connections, '0' otherwise.",
+			[]string{"tag"},
+			constLabels,
+		),
+		tagsTotalDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "tags_total"),
+			"The number of tags defined in Collins.",
+			nil,
+			constLabels,
+		),
+		stateInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "state_info"),
+			"Constant metric with value '1' providing the name, label, and status of the Collins state with the given ID.",
+			[]string{"state_id", "name", "label", "status"},
+			constLabels,
+		),
+		assetStateAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "state_age_seconds"),
+			"The time since the last update of the asset with the given tag, which has the given transitional status.",
+			[]string{"tag", "status"},
+			constLabels,
+		),
+		assetIPMIConfiguredDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "ipmi_configured"),
+			"'1' if the asset with the given tag has an IPMI address in Collins, '0' otherwise.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetAddressInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "address_info"),
+			"Constant metric with value '1' providing an IP address and its Collins address pool for the asset with the given tag.",
+			[]string{"tag", "address", "pool"},
+			constLabels,
+		),
+		serverInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "server_info"),
+			"Constant metric with value '1' providing the version of the Collins server.",
+			[]string{"version"},
+			constLabels,
+		),
+		assetAddressCountDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "address_count"),
+			"The number of IP addresses of the asset with the given tag.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetHostnameInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "hostname_info"),
+			"Constant metric with value '1' providing the hostname for the asset with the given tag.",
+			[]string{"tag", "hostname"},
+			constLabels,
+		),
+		assetLogSeverityDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "log_severity"),
+			"The number of recent logs of the asset with the given tag with the given severity.",
+			[]string{"tag", "severity"},
+			constLabels,
+		),
+		assetPowerWattsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "power_watts"),
+			"The power draw of the asset with the given tag in watts as reported by its Collins attribute.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetInMaintenanceDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "in_maintenance"),
+			"'1' if the asset with the given tag has the Collins status Maintenance, '0' otherwise.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetStatusTransitionsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "status_transitions_total"),
+			"Total number of changes of the Collins status of the asset with the given tag observed between scrapes.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetMissingNodeclassDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "missing_nodeclass"),
+			"'1' if the asset with the given tag has no nodeclass, '0' otherwise.",
+			[]string{"tag"},
+			constLabels,
+		),
+		assetsMissingNodeclassDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "assets_missing_nodeclass"),
+			"Number of assets without a nodeclass.",
+			nil,
+			constLabels,
+		),
+		assetsUnknownStatusDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "assets_unknown_status"),
+			"Number of assets with a Collins status unknown to the exporter.",
 			nil,
+			constLabels,
+		),
+		assetAttributesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "attributes"),
+			"Constant metric with value '1' providing the value of a Collins attribute of the asset with the given tag.",
+			[]string{"tag", "key", "value"},
+			constLabels,
+		),
+		assetProvisionInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "provision_info"),
+			"Constant metric with value '1' providing the provisioning profile, primary role, and pool of the asset with the given tag.",
+			[]string{"tag", "profile", "role", "pool"},
+			constLabels,
+		),
+		assetIntakeAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "intake_age_seconds"),
+			"The time since the creation of the asset with the given tag, which has the given intake status.",
+			[]string{"tag", "status"},
+			constLabels,
+		),
+		intakeBacklogDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "intake_backlog"),
+			"The number of assets with the given intake status.",
+			[]string{"status"},
+			constLabels,
+		),
+		assetUnknownStatusDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "unknown_status"),
+			"Constant metric with value '1' providing the Collins status of the asset with the given tag if it is unknown to the exporter.",
+			[]string{"tag", "status"},
+			constLabels,
 		),
+		assetLinkInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "link_info"),
+			"Constant metric with value '1' providing the URL of the page of the asset with the given tag in the Collins web UI.",
+			[]string{"tag", "url"},
+			constLabels,
+		),
+		assetFlaggedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asset", "flagged"),
+			"'1' if the asset with the given tag matches the flag query, '0' otherwise.",
+			[]string{"tag"},
+			constLabels,
+		),
+	}
+	// Export all reasons from the start, so that they are 0 until the
+	// first failure.
+	for _, reason := range scrapeErrorReasons {
+		e.scrapeError.WithLabelValues(reason)
 	}
+	return e, nil
 }
 
-// Loop manages scrapes of Collins triggered by scrapes of the exporter.
+// Loop manages scrapes of Collins, either triggered by scrapes of the exporter
+// or, if a scrape interval is configured, by a ticker. At most one scrape runs
+// at a time. Requests for metrics arriving while a scrape is in progress wait
+// for its result. Otherwise, they trigger a new scrape, unless the last result
+// is younger than the cache TTL or a scrape interval is configured, in which
+// case they get the last result right away. If warm-up is enabled, Collins is
+// scraped upon start, and the first request gets the result of that scrape
+// regardless of the cache TTL. If a scrape jitter is configured, the ticker and
+// the first scrape are delayed randomly, and requests arriving in the meantime
+// wait for the result of the first scrape.
 func (e *Exporter) Loop() {
+	var (
+		tick    <-chan time.Time
+		done    chan struct{} // Not nil while a scrape is in progress.
+		waiting []chan scrapeResult
+		result  scrapeResult
+		scraped bool
+		// warmUpStart is the start of the warm-up scrape, or the zero
+		// time if there is none. warm is true while the result of the
+		// warm-up scrape has not been served yet.
+		warmUpStart time.Time
+		warm        bool
+	)
+	startScrape := func() {
+		done = make(chan struct{})
+		go func(done chan struct{}) {
+			e.scrapeCollins()
+			close(done)
+		}(done)
+	}
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	// jitter fires when the ticker-based scrapes start after the random
+	// delay of ScrapeJitter.
+	var jitter <-chan time.Time
+	if e.config.ScrapeInterval > 0 && e.config.ScrapeJitter > 0 {
+		// The global source of math/rand is not seeded, which would
+		// result in the same delay for all replicas.
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		delay := time.Duration(random.Int63n(int64(e.config.ScrapeJitter)))
+		log.Infof("Delaying the first Collins scrape by %v", delay)
+		jitter = time.After(delay)
+	} else if e.config.ScrapeInterval > 0 {
+		ticker = time.NewTicker(e.config.ScrapeInterval)
+		tick = ticker.C
+		startScrape()
+	} else if e.config.WarmUp {
+		warmUpStart = time.Now()
+		startScrape()
+	}
 	for {
 		select {
-		case <-e.requestScrape:
-			e.scrapeCollins()
-		case e.scrapeResult <- e.lastScrapeResult:
+		case reply := <-e.requests:
+			switch {
+			case e.config.ScrapeInterval > 0 && scraped:
+				reply <- result
+			case warm:
+				warm = false
+				reply <- result
+			case done != nil, jitter != nil:
+				// The first scrape of a delayed ticker starts
+				// once jitter fires.
+				waiting = append(waiting, reply)
+			case scraped && time.Since(e.lastScrapeEnd) < e.config.CacheTTL:
+				log.Debugf("Serving cached result of Collins scrape, age %v", time.Since(e.lastScrapeEnd))
+				reply <- result
+			default:
+				waiting = append(waiting, reply)
+				startScrape()
+			}
+		case <-jitter:
+			jitter = nil
+			ticker = time.NewTicker(e.config.ScrapeInterval)
+			tick = ticker.C
+			if done == nil {
+				startScrape()
+			}
+		case <-tick:
+			if done == nil {
+				startScrape()
+			}
+		case <-done:
+			done = nil
+			result = scrapeResult{metrics: e.lastScrapeResult, attributes: e.lastScrapeAttributes}
+			scraped = true
+			if !warmUpStart.IsZero() {
+				log.Infof("Warm-up scrape of Collins finished in %v", time.Since(warmUpStart))
+				// Requests waiting for the warm-up scrape get its
+				// result below.
+				warmUpStart, warm = time.Time{}, len(waiting) == 0
+			}
+			for _, reply := range waiting {
+				reply <- result
+			}
+			waiting = nil
 		}
 	}
 }
 
-func (e *Exporter) scrapeCollins() {
+// scrapeCollins scrapes Collins and stores the resulting asset metrics as the
+// last scrape result. It returns the error of a failed scrape, whose result is
+// discarded. A partial result exported as configured by AllowPartial does not
+// count as a failure.
+func (e *Exporter) scrapeCollins() error {
 	log.Debugln("Starting Collins scrape...")
-	e.lastScrapeResult = nil
+	e.scrapeInProgress.Set(1)
+	defer e.scrapeInProgress.Set(0)
+
+	ctx := context.Background()
+	if e.config.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.config.ScrapeTimeout)
+		defer cancel()
+	}
 
 	start := time.Now()
-	assets, err := getAllAssets(e.client)
+	var (
+		assets []collins.Asset
+		reason string
+	)
+	err := e.setupClient()
+	if err != nil {
+		reason = "config"
+	} else {
+		err = e.checkBreaker()
+	}
+	if err == errBreakerOpen {
+		// Collins is not scraped at all, so there is no scrape to observe.
+		log.Debugln("Skipping Collins scrape while the circuit breaker is open")
+		e.scrapesSkipped.Inc()
+		for _, r := range scrapeErrorReasons {
+			e.scrapeError.WithLabelValues(r).Set(0)
+		}
+		e.scrapeError.WithLabelValues("breaker").Set(1)
+		e.lastScrapeResult, e.lastScrapeAttributes = nil, nil
+		e.up.Set(0)
+		e.scrapeComplete.Set(0)
+		e.setLastSuccess(time.Time{})
+		return err
+	}
+	if err == nil {
+		var result assetPages
+		result, err = e.getAssets(ctx, start)
+		assets = result.assets
+		if len(result.failedPages) > 0 {
+			log.Errorf("Could not retrieve pages %v of assets", result.failedPages)
+			e.failedPages.Add(float64(len(result.failedPages)))
+		}
+	}
 	took := time.Since(start)
+	if err == context.DeadlineExceeded {
+		log.Errorf("Collins scrape abandoned after %v", took)
+	}
 	e.scrapeDuration.Set(took.Seconds())
+	e.scrapeDurations.Observe(took.Seconds())
+	// The first scrape starts the average.
+	if e.lastScrapeEnd.IsZero() {
+		e.scrapeDurationAverage = took.Seconds()
+	} else {
+		alpha := e.config.ScrapeDurationSmoothing
+		e.scrapeDurationAverage = alpha*took.Seconds() + (1-alpha)*e.scrapeDurationAverage
+	}
+	e.scrapeDurationEMA.Set(e.scrapeDurationAverage)
+	e.lastScrapeEnd = time.Now()
+	e.lastScrapeTimestamp.Set(float64(e.lastScrapeEnd.UnixNano()) / 1e9)
 	e.scrapesTotal.Inc()
 	log.Infof("Collins scrape finished, found %d assets in %v", len(assets), took)
 
-	if err != nil {
+	// While there might be asset data retrieved, we do not want to create
+	// metrics based on partial results unless explicitly allowed. Thus,
+	// return here.
+	failed := err != nil && !(e.config.AllowPartial && len(assets) > 0)
+	if failed {
+		e.consecutiveFailures++
+		if e.config.BreakerThreshold > 0 && e.consecutiveFailures >= e.config.BreakerThreshold {
+			log.Warnf("%d consecutive Collins scrapes failed, not scraping Collins for %v", e.consecutiveFailures, e.config.BreakerCooldown)
+			e.breakerOpenUntil = time.Now().Add(e.config.BreakerCooldown)
+		}
+	} else {
+		e.consecutiveFailures = 0
+	}
+	if e.config.BreakerThreshold > 0 && e.consecutiveFailures >= e.config.BreakerThreshold {
+		e.circuitOpen.Set(1)
+	} else {
+		e.circuitOpen.Set(0)
+	}
+
+	for _, r := range scrapeErrorReasons {
+		e.scrapeError.WithLabelValues(r).Set(0)
+	}
+	if failed {
+		if reason == "" {
+			reason = scrapeErrorReason(err)
+		}
+		e.scrapeError.WithLabelValues(reason).Set(1)
+		e.lastScrapeResult, e.lastScrapeAttributes = nil, nil
 		e.up.Set(0)
+		e.scrapeComplete.Set(0)
+		e.setLastSuccess(time.Time{})
 		e.scrapeFailures.Inc()
-		// While there might be asset data retrieved, we do not want to
-		// create metrics based on partial results. Thus, return here.
-		// However, should we ever wish to return metrics based on
-		// partial results, this would be the place to change.
-		return
+		return err
+	}
+	if err != nil {
+		log.Warnf("Exporting partial result of %d assets", len(assets))
+		e.partialScrapes.Inc()
+		e.scrapeComplete.Set(0)
+	} else {
+		e.scrapeComplete.Set(1)
 	}
 	e.up.Set(1)
+	e.assetsScraped.Set(float64(len(assets)))
+	e.lastSuccessTimestamp.Set(float64(e.lastScrapeEnd.UnixNano()) / 1e9)
+	e.setLastSuccess(time.Now())
+
+	assets = e.dedupTags(e.filterTags(assets))
+	e.trackStatuses(assets, err == nil)
+	e.lastScrapeAttributes = make(map[string]map[string]string, len(assets))
+	for _, asset := range assets {
+		e.lastScrapeAttributes[e.exportedTag(asset)] = asset.Attributes["0"]
+	}
+
+	var ipmiReachable map[string]bool
+	if e.config.ProbeIPMI {
+		ipmiReachable = probeAllIPMI(ctx, assets, e.config.IPMIProbePort, e.config.IPMIProbeTimeout, e.config.IPMIProbeConcurrency)
+	}
+	// If the flag query fails, no asset is flagged rather than all of them
+	// being reported as not flagged.
+	var flagged map[string]bool
+	if e.config.FlagQuery != "" {
+		var err error
+		if flagged, err = e.getFlaggedTags(ctx); err != nil {
+			log.Errorf("Could not retrieve the assets matching the flag query: %s", err)
+		}
+	}
+	if e.client == nil {
+		// The assets were retrieved by a finder passed to
+		// NewExporterWithFinder, so there is no client to retrieve
+		// anything else.
+		e.lastScrapeResult = e.assetMetrics(assets, nil, ipmiReachable, nil, flagged)
+		return nil
+	}
+	if e.config.CollectHardware {
+		failures := getAllHardware(ctx, e.client, assets, e.config.HardwareConcurrency)
+		e.hardwareFailures.Add(float64(failures))
+	}
+	var powerOn map[string]bool
+	if e.config.CollectPower {
+		powerOn = getAllPowerStatus(ctx, e.client, assets, e.config.PowerConcurrency)
+	}
+	var logSeverities map[string]map[string]int
+	if e.config.CollectLogs {
+		logSeverities = getAllLogSeverities(ctx, e.client, assets, e.config.LogLimit, e.config.LogMaxAge, e.config.LogConcurrency)
+	}
+
+	metrics := e.assetMetrics(assets, powerOn, ipmiReachable, logSeverities, flagged)
+	metrics = append(metrics, e.tagMetrics(ctx)...)
+	metrics = append(metrics, e.serverInfoMetrics(ctx)...)
+	e.lastScrapeResult = append(metrics, e.stateMetrics(ctx)...)
+	return nil
+}
 
+// assetMetrics creates the metrics for the given assets. powerOn and
+// ipmiReachable map asset tags to their power status and IPMI reachability,
+// if known. logSeverities maps asset tags to the number of their recent logs
+// per severity, if known. flagged contains the tags of the assets matching the
+// flag query. If it is nil, no flag metrics are created.
+func (e *Exporter) assetMetrics(assets []collins.Asset, powerOn, ipmiReachable map[string]bool, logSeverities map[string]map[string]int, flagged map[string]bool) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	now := time.Now()
+	statusCounts := make(map[string]int, len(statusNames))
+	nodeclassCounts := map[string]int{}
+	datacenterCounts := map[string]int{}
+	unknownStatuses := 0
 	for _, asset := range assets {
-		primaryAddress := ""
-		if len(asset.Addresses) > 0 {
-			primaryAddress = asset.Addresses[0].Address
+		tag := e.exportedTag(asset)
+		first := len(metrics)
+
+		statusCounts[asset.Metadata.Status]++
+		nodeclassCounts[asset.Classification.Tag]++
+		datacenter := assetAttribute(asset, "DATACENTER")
+		if datacenter == "" {
+			datacenter = "unknown"
+		}
+		datacenterCounts[datacenter]++
+
+		primaryAddress := e.primaryAddress(asset)
+
+		// The type label of the status, state, and details metrics is
+		// only added if enabled.
+		var typeLabel []string
+		if e.config.ExportTypeLabel {
+			typeLabel = []string{asset.Metadata.Type}
 		}
 
 		for _, status := range statusNames {
@@ -147,118 +1295,1798 @@ func (e *Exporter) scrapeCollins() {
 			if asset.Metadata.Status == status {
 				value = 1
 			}
-			e.lastScrapeResult = append(e.lastScrapeResult, prometheus.MustNewConstMetric(
+			metrics = append(metrics, prometheus.MustNewConstMetric(
 				e.assetStatusDesc,
 				prometheus.GaugeValue,
 				value,
-				asset.Metadata.Tag, status,
+				append([]string{tag, status}, typeLabel...)...,
+			))
+		}
+		// Assets with a status missing from statusNames would have a
+		// value of 0 for all statuses above.
+		if !knownStatus(asset.Metadata.Status) {
+			log.Warnf("Asset %s has the unknown status %q", asset.Metadata.Tag, asset.Metadata.Status)
+			unknownStatuses++
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetUnknownStatusDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, asset.Metadata.Status,
+			))
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetStatusTransitionsDesc,
+			prometheus.CounterValue,
+			float64(e.statusTransitions[tag]),
+			tag,
+		))
+		var missingNodeclass float64
+		if asset.Classification.Tag == "" {
+			missingNodeclass = 1
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetMissingNodeclassDesc,
+			prometheus.GaugeValue,
+			missingNodeclass,
+			tag,
+		))
+		var inMaintenance float64
+		if asset.Metadata.Status == "Maintenance" {
+			inMaintenance = 1
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetInMaintenanceDesc,
+			prometheus.GaugeValue,
+			inMaintenance,
+			tag,
+		))
+		if flagged != nil {
+			var value float64
+			if flagged[asset.Metadata.Tag] {
+				value = 1
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetFlaggedDesc,
+				prometheus.GaugeValue,
+				value,
+				tag,
 			))
 		}
-		e.lastScrapeResult = append(e.lastScrapeResult, prometheus.MustNewConstMetric(
+		metrics = append(metrics, prometheus.MustNewConstMetric(
 			e.assetStateDesc,
 			prometheus.GaugeValue,
 			float64(asset.Metadata.State.ID),
-			asset.Metadata.Tag,
+			append([]string{tag}, typeLabel...)...,
+		))
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetStateInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			tag, asset.Metadata.State.Name, asset.Metadata.State.Label,
 		))
-		e.lastScrapeResult = append(e.lastScrapeResult, prometheus.MustNewConstMetric(
+		if created, err := parseTimestamp(asset.Metadata.Created); err == nil {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetCreatedDesc,
+				prometheus.GaugeValue,
+				created,
+				tag,
+			))
+			for _, status := range e.config.IntakeStatuses {
+				if status == asset.Metadata.Status {
+					metrics = append(metrics, prometheus.MustNewConstMetric(
+						e.assetIntakeAgeDesc,
+						prometheus.GaugeValue,
+						float64(now.UnixNano())/1e9-created,
+						tag, status,
+					))
+				}
+			}
+		} else {
+			log.Debugf("Not exporting creation time of asset %s: %s", asset.Metadata.Tag, err)
+		}
+		if updated, err := parseTimestamp(asset.Metadata.Updated); err == nil {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetUpdatedDesc,
+				prometheus.GaugeValue,
+				updated,
+				tag,
+			))
+			for _, status := range e.config.StateAgeStatuses {
+				if status == asset.Metadata.Status {
+					metrics = append(metrics, prometheus.MustNewConstMetric(
+						e.assetStateAgeDesc,
+						prometheus.GaugeValue,
+						float64(now.UnixNano())/1e9-updated,
+						tag, asset.Metadata.Status,
+					))
+				}
+			}
+		} else {
+			log.Debugf("Not exporting update time of asset %s: %s", asset.Metadata.Tag, err)
+		}
+		ipmiAddress := asset.IPMI.Address
+		if e.config.RedactIPMI && ipmiAddress != "" {
+			ipmiAddress = redactedIPMIAddress
+		}
+		details := append([]string{tag, asset.Classification.Tag, ipmiAddress, primaryAddress}, typeLabel...)
+		for _, key := range e.config.DetailAttributes {
+			details = append(details, assetAttribute(asset, key))
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
 			e.assetDetailsDesc,
 			prometheus.GaugeValue,
 			1,
-			asset.Metadata.Tag, asset.Classification.Tag, asset.IPMI.Address, primaryAddress,
+			details...,
 		))
-	}
-}
-
-// Describe implements prometheus.Collector.
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.assetStatusDesc
-	ch <- e.assetStateDesc
-	ch <- e.up.Desc()
-	ch <- e.scrapesTotal.Desc()
-	ch <- e.scrapeFailures.Desc()
-	ch <- e.scrapeDuration.Desc()
-}
-
-// Collect implements prometheus.Collector. It only initiates a scrape of
-// Collins if no scrape is currently ongoing. If a scrape of Collins is
-// currently ongoing, Collect waits for it to end and then uses its result to
-// collect the metrics.
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	select {
-	case e.requestScrape <- struct{}{}:
-	default: // Scraping already underway.
-	}
-	for _, metric := range <-e.scrapeResult {
-		ch <- metric
-	}
-	ch <- e.up
-	ch <- e.scrapesTotal
-	ch <- e.scrapeFailures
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetPoolInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			tag, assetAttribute(asset, "POOL"),
+		))
+		// Provisioning stores the nodeclass of the profile, the roles,
+		// and the pool as attributes.
+		profile, role, pool := assetAttribute(asset, "NODECLASS"), assetAttribute(asset, "PRIMARY_ROLE"), assetAttribute(asset, "POOL")
+		if profile != "" || role != "" || pool != "" {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetProvisionInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, profile, role, pool,
+			))
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetHostnameInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			tag, assetAttribute(asset, "HOSTNAME"),
+		))
+		if link := e.assetLink(asset); link != "" {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetLinkInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, link,
+			))
+		}
+		if e.config.ExportAttributes {
+			metrics = append(metrics, e.attributeMetrics(asset, tag)...)
+		}
+		for _, attr := range e.numericAttributes {
+			value := assetAttribute(asset, attr.key)
+			if value == "" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				metrics = append(metrics, prometheus.MustNewConstMetric(
+					attr.desc,
+					prometheus.GaugeValue,
+					v,
+					tag,
+				))
+			} else {
+				log.Debugf("Not exporting non-numeric %s attribute of asset %s: %q", attr.key, asset.Metadata.Tag, value)
+			}
+		}
+		if e.config.PowerWattsAttribute != "" {
+			if value := assetAttribute(asset, e.config.PowerWattsAttribute); value != "" {
+				if watts, err := parseWatts(value); err == nil {
+					metrics = append(metrics, prometheus.MustNewConstMetric(
+						e.assetPowerWattsDesc,
+						prometheus.GaugeValue,
+						watts,
+						tag,
+					))
+				} else {
+					log.Debugf("Invalid %s attribute of asset %s: %s", e.config.PowerWattsAttribute, asset.Metadata.Tag, err)
+				}
+			}
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetAddressCountDesc,
+			prometheus.GaugeValue,
+			float64(len(asset.Addresses)),
+			tag,
+		))
+		// Collins might list an address more than once, but each
+		// address must result in a single metric.
+		addresses := make(map[string]bool, len(asset.Addresses))
+		for _, address := range asset.Addresses {
+			if addresses[address.Address] {
+				continue
+			}
+			addresses[address.Address] = true
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetAddressInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, address.Address, address.Pool,
+			))
+		}
+
+		// Assets without CPU data (e.g. because hardware collection is
+		// disabled or the asset has not been through intake yet) do
+		// not get CPU metrics rather than misleading zeros.
+		if len(asset.CPUs) > 0 {
+			var cores, threads int
+			for _, cpu := range asset.CPUs {
+				cores += cpu.Cores
+				threads += cpu.Threads
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetCPUCoresDesc,
+				prometheus.GaugeValue,
+				float64(cores),
+				tag,
+			))
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetCPUThreadsDesc,
+				prometheus.GaugeValue,
+				float64(threads),
+				tag,
+			))
+		}
+		if memory, ok := memoryBytes(asset); ok {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetMemoryBytesDesc,
+				prometheus.GaugeValue,
+				memory,
+				tag,
+			))
+		}
+		if count, capacity, ok := diskStats(asset); ok {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetDiskCountDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				tag,
+			))
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetDiskCapacityDesc,
+				prometheus.GaugeValue,
+				capacity,
+				tag,
+			))
+		}
+		var ipmiConfigured float64
+		if asset.IPMI.Address != "" {
+			ipmiConfigured = 1
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetIPMIConfiguredDesc,
+			prometheus.GaugeValue,
+			ipmiConfigured,
+			tag,
+		))
+		if on, ok := powerOn[asset.Metadata.Tag]; ok {
+			var value float64
+			if on {
+				value = 1
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetPowerOnDesc,
+				prometheus.GaugeValue,
+				value,
+				tag,
+			))
+		}
+		for severity, count := range logSeverities[asset.Metadata.Tag] {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetLogSeverityDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				tag, severity,
+			))
+		}
+		if ok, probed := ipmiReachable[asset.Metadata.Tag]; probed {
+			var value float64
+			if ok {
+				value = 1
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetIPMIReachableDesc,
+				prometheus.GaugeValue,
+				value,
+				tag,
+			))
+		}
+
+		if e.config.UseAssetTimestamps {
+			if updated, err := parseTimestamp(asset.Metadata.Updated); err == nil {
+				t := time.Unix(0, int64(updated*1e9))
+				for i := first; i < len(metrics); i++ {
+					metrics[i] = timestampedMetric{Metric: metrics[i], t: t}
+				}
+			}
+		}
+	}
+
+	for _, status := range statusNames {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetsByStatusDesc,
+			prometheus.GaugeValue,
+			float64(statusCounts[status]),
+			status,
+		))
+	}
+	for _, status := range e.config.IntakeStatuses {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.intakeBacklogDesc,
+			prometheus.GaugeValue,
+			float64(statusCounts[status]),
+			status,
+		))
+	}
+	for nodeclass, count := range nodeclassCounts {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetsByNodeclassDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			nodeclass,
+		))
+	}
+	for datacenter, count := range datacenterCounts {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.assetsByDatacenterDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			datacenter,
+		))
+	}
+	if e.config.ExportAttributes && len(e.config.AttributeWhitelist) == 0 {
+		series := 0
+		for _, asset := range assets {
+			series += len(asset.Attributes["0"])
+		}
+		if series > attributeSeriesWarnThreshold {
+			log.Warnf("Exporting all %d attributes of all assets, set -collins.attribute-whitelist to export fewer", series)
+		}
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(
+		e.assetsMissingNodeclassDesc,
+		prometheus.GaugeValue,
+		float64(nodeclassCounts[""]),
+	))
+	metrics = append(metrics, prometheus.MustNewConstMetric(
+		e.assetsUnknownStatusDesc,
+		prometheus.GaugeValue,
+		float64(unknownStatuses),
+	))
+
+	return metrics
+}
+
+// assetLink returns the URL of the page of the given asset in the Collins web
+// UI, resolved against the host of the Collins client like its API requests.
+// Without a client, e.g. with a finder passed to NewExporterWithFinder, it
+// returns the empty string.
+func (e *Exporter) assetLink(asset collins.Asset) string {
+	if e.client == nil || e.client.BaseURL == nil {
+		return ""
+	}
+	link := e.client.BaseURL.ResolveReference(&url.URL{Path: "asset/" + asset.Metadata.Tag})
+	link.User = nil
+	return link.String()
+}
+
+// primaryAddress returns the first address of the given asset in the
+// configured primary address pool, falling back to its first address.
+func (e *Exporter) primaryAddress(asset collins.Asset) string {
+	if len(asset.Addresses) == 0 {
+		return ""
+	}
+	if e.config.PrimaryAddressPool != "" {
+		for _, address := range asset.Addresses {
+			if address.Pool == e.config.PrimaryAddressPool {
+				return address.Address
+			}
+		}
+	}
+	return asset.Addresses[0].Address
+}
+
+// filterTags returns the given assets whose tags match none of the TagDeny
+// patterns and, if there are any, one of the TagAllow patterns. It reuses the
+// backing array of assets.
+func (e *Exporter) filterTags(assets []collins.Asset) []collins.Asset {
+	if len(e.config.TagAllow) == 0 && len(e.config.TagDeny) == 0 {
+		return assets
+	}
+	filtered := assets[:0]
+	for _, asset := range assets {
+		if matchAny(e.config.TagDeny, asset.Metadata.Tag) {
+			continue
+		}
+		if len(e.config.TagAllow) > 0 && !matchAny(e.config.TagAllow, asset.Metadata.Tag) {
+			continue
+		}
+		filtered = append(filtered, asset)
+	}
+	return filtered
+}
+
+// dedupTags returns the given assets without those whose exported tag, see
+// exportedTag, is the same as that of a preceding asset, as their metrics
+// would collide. It reuses the backing array of assets.
+func (e *Exporter) dedupTags(assets []collins.Asset) []collins.Asset {
+	originalTags := make(map[string]string, len(assets))
+	deduped := assets[:0]
+	for _, asset := range assets {
+		tag := e.exportedTag(asset)
+		if other, ok := originalTags[tag]; ok {
+			if other == asset.Metadata.Tag {
+				log.Warnf("More than one asset has the tag %s, only exporting the first", other)
+			} else {
+				log.Warnf("Assets %s and %s have the same lowercase tag, not exporting the latter", other, asset.Metadata.Tag)
+			}
+			e.duplicateTags.Inc()
+			continue
+		}
+		originalTags[tag] = asset.Metadata.Tag
+		deduped = append(deduped, asset)
+	}
+	return deduped
+}
+
+// trackStatuses counts the status transitions of the given assets since the
+// last successful scrape. Assets not seen before start without transitions. If
+// complete is true, the assets are all assets of the query, and the tracked
+// state of assets not among them is dropped.
+func (e *Exporter) trackStatuses(assets []collins.Asset, complete bool) {
+	seen := make(map[string]bool, len(assets))
+	for _, asset := range assets {
+		tag := e.exportedTag(asset)
+		seen[tag] = true
+		if status, ok := e.statuses[tag]; ok && status != asset.Metadata.Status {
+			e.statusTransitions[tag]++
+		}
+		e.statuses[tag] = asset.Metadata.Status
+	}
+	if !complete {
+		return
+	}
+	for tag := range e.statuses {
+		if !seen[tag] {
+			delete(e.statuses, tag)
+			delete(e.statusTransitions, tag)
+		}
+	}
+}
+
+// exportedTag returns the value of the tag label of the metrics of the given
+// asset.
+func (e *Exporter) exportedTag(asset collins.Asset) string {
+	if e.config.LowercaseTags {
+		return strings.ToLower(asset.Metadata.Tag)
+	}
+	return asset.Metadata.Tag
+}
+
+// matchAny returns whether s matches any of the given patterns.
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupClient sets up the Collins client if that has failed before, e.g.
+// because of a transient problem at startup.
+func (e *Exporter) setupClient() error {
+	// An injected AssetFinder is never replaced.
+	if e.finder != nil && e.client == nil {
+		return nil
+	}
+	e.mtx.Lock()
+	reloaded := e.reloadedClient
+	e.reloadedClient = nil
+	e.mtx.Unlock()
+	if reloaded != nil {
+		log.Infoln("Switching to reloaded collins client")
+		e.client = reloaded
+		e.finder = reloaded.Assets
+		return nil
+	}
+	if e.finder != nil {
+		return nil
+	}
+	client, err := e.newClient()
+	if err != nil {
+		log.Errorf("Could not set up collins client: %s", err)
+		return err
+	}
+	log.Infoln("Collins client set up successfully")
+	e.client = client
+	e.finder = client.Assets
+	return nil
+}
+
+// newClient creates a Collins client from the configured Collins config, which
+// sends its requests with the configured transport.
+func (e *Exporter) newClient() (*collins.Client, error) {
+	client, err := newCollinsClient(e.config.CollinsConfig, e.config.Profile, e.config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if e.config.Transport != nil {
+		if err := setHTTPClient(client, &http.Client{Transport: e.config.Transport}); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// BuildClient builds a new Collins client from the configured Collins config,
+// e.g. to pick up rotated credentials, without using it yet. See SwapClient.
+func (e *Exporter) BuildClient() (*collins.Client, error) {
+	client, err := e.newClient()
+	if err != nil {
+		return nil, err
+	}
+	// A config without a host still results in a client, which would
+	// fail every scrape.
+	if client.BaseURL == nil || client.BaseURL.Host == "" {
+		return nil, errors.New("no Collins host configured")
+	}
+	return client, nil
+}
+
+// SwapClient makes the next scrape of Collins switch to the given client
+// built by BuildClient.
+func (e *Exporter) SwapClient(client *collins.Client) {
+	e.mtx.Lock()
+	e.reloadedClient = client
+	e.mtx.Unlock()
+}
+
+// reloadClients builds new Collins clients for all of the given Exporters and
+// only swaps them in if all of them could be built, so that the Exporters do
+// not end up with a mix of old and new Collins configs. Otherwise, the current
+// clients are kept and the error of the first failed Exporter is returned.
+func reloadClients(exporters []*Exporter) error {
+	clients := make([]*collins.Client, len(exporters))
+	for i, e := range exporters {
+		client, err := e.BuildClient()
+		if err != nil {
+			return fmt.Errorf("could not reload Collins config %q: %s", redactURL(e.config.CollinsConfig), err)
+		}
+		clients[i] = client
+	}
+	for i, e := range exporters {
+		e.SwapClient(clients[i])
+		log.Infof("Reloaded Collins config %q", redactURL(e.config.CollinsConfig))
+	}
+	return nil
+}
+
+func (e *Exporter) setLastSuccess(t time.Time) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.lastSuccess = t
+}
+
+// Ready returns whether the last scrape of Collins was successful and ended
+// less than maxAge ago.
+func (e *Exporter) Ready(maxAge time.Duration) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return !e.lastSuccess.IsZero() && time.Since(e.lastSuccess) < maxAge
+}
+
+// SelfCollector returns a collector of the metrics about the scrapes of Collins
+// by the Exporter. It never initiates a scrape.
+func (e *Exporter) SelfCollector() prometheus.Collector {
+	return selfCollector{e}
+}
+
+// AssetCollector returns a collector of the asset metrics. Its Collect method
+// only initiates a scrape of Collins if no scrape is currently ongoing. If a
+// scrape of Collins is currently ongoing, Collect waits for it to end and then
+// uses its result to collect the metrics. If a scrape interval is configured,
+// Collect never initiates a scrape but uses the result of the last one. The
+// Exporter's Loop must be running.
+func (e *Exporter) AssetCollector() prometheus.Collector {
+	return assetCollector{e}
+}
+
+// selfCollector collects the metrics about the scrapes of an Exporter.
+type selfCollector struct {
+	e *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (c selfCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.describeScrapeMetrics(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c selfCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.collectScrapeMetrics(ch)
+}
+
+// assetCollector collects the asset metrics of an Exporter through its Loop.
+type assetCollector struct {
+	e *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (c assetCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.describeAssetMetrics(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c assetCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c.e.result().metrics {
+		ch <- metric
+	}
+}
+
+// scrapeResult is the result of a scrape of Collins handed out by Loop.
+type scrapeResult struct {
+	// metrics are the asset metrics.
+	metrics []prometheus.Metric
+	// attributes maps the exported tags of the assets to their Collins
+	// attributes.
+	attributes map[string]map[string]string
+}
+
+// result requests a scrape result from Loop, see AssetCollector, and returns
+// it.
+func (e *Exporter) result() scrapeResult {
+	// The reply channel is buffered, so that Loop never blocks on it.
+	reply := make(chan scrapeResult, 1)
+	e.collectWaiters.Inc()
+	e.requests <- reply
+	result := <-reply
+	e.collectWaiters.Dec()
+	return result
+}
+
+// describeAssetMetrics sends the descriptors of the asset metrics to the given
+// channel.
+func (e *Exporter) describeAssetMetrics(ch chan<- *prometheus.Desc) {
+	for _, attr := range e.numericAttributes {
+		ch <- attr.desc
+	}
+	ch <- e.assetStatusDesc
+	ch <- e.assetStateDesc
+	ch <- e.assetStateInfoDesc
+	ch <- e.assetCreatedDesc
+	ch <- e.assetUpdatedDesc
+	ch <- e.assetCPUCoresDesc
+	ch <- e.assetCPUThreadsDesc
+	ch <- e.assetMemoryBytesDesc
+	ch <- e.assetPowerOnDesc
+	ch <- e.assetsByStatusDesc
+	ch <- e.assetPoolInfoDesc
+	ch <- e.assetDiskCountDesc
+	ch <- e.assetDiskCapacityDesc
+	ch <- e.assetsByNodeclassDesc
+	ch <- e.assetsByDatacenterDesc
+	ch <- e.assetIPMIReachableDesc
+	ch <- e.tagsTotalDesc
+	ch <- e.stateInfoDesc
+	ch <- e.assetStateAgeDesc
+	ch <- e.assetIPMIConfiguredDesc
+	ch <- e.assetAddressInfoDesc
+	ch <- e.serverInfoDesc
+	ch <- e.assetAddressCountDesc
+	ch <- e.assetHostnameInfoDesc
+	ch <- e.assetLogSeverityDesc
+	ch <- e.assetPowerWattsDesc
+	ch <- e.assetInMaintenanceDesc
+	ch <- e.assetStatusTransitionsDesc
+	ch <- e.assetMissingNodeclassDesc
+	ch <- e.assetsMissingNodeclassDesc
+	ch <- e.assetsUnknownStatusDesc
+	ch <- e.assetAttributesDesc
+	ch <- e.assetProvisionInfoDesc
+	ch <- e.assetIntakeAgeDesc
+	ch <- e.intakeBacklogDesc
+	ch <- e.assetFlaggedDesc
+	ch <- e.assetUnknownStatusDesc
+	ch <- e.assetLinkInfoDesc
+}
+
+// describeScrapeMetrics sends the descriptors of the metrics about the scrapes
+// of Collins and their query to the given channel.
+func (e *Exporter) describeScrapeMetrics(ch chan<- *prometheus.Desc) {
+	ch <- e.queryInfo.Desc()
+	ch <- e.up.Desc()
+	ch <- e.scrapeComplete.Desc()
+	ch <- e.circuitOpen.Desc()
+	ch <- e.scrapeInProgress.Desc()
+	ch <- e.collectWaiters.Desc()
+	ch <- e.assetsScraped.Desc()
+	ch <- e.scrapePages.Desc()
+	ch <- e.assetsTruncated.Desc()
+	ch <- e.partialScrapes.Desc()
+	ch <- e.failedPages.Desc()
+	ch <- e.scrapesTotal.Desc()
+	ch <- e.scrapeFailures.Desc()
+	ch <- e.scrapesSkipped.Desc()
+	ch <- e.scrapeRetries.Desc()
+	ch <- e.hardwareFailures.Desc()
+	ch <- e.duplicateTags.Desc()
+	e.scrapeError.Describe(ch)
+	ch <- e.scrapeDuration.Desc()
+	ch <- e.scrapeDurationEMA.Desc()
+	ch <- e.scrapeDurations.Desc()
+	ch <- e.pageDurations.Desc()
+	ch <- e.lastScrapeTimestamp.Desc()
+	ch <- e.lastSuccessTimestamp.Desc()
+}
+
+// collectScrapeMetrics sends the metrics about the scrapes of Collins and their
+// query to the given channel.
+func (e *Exporter) collectScrapeMetrics(ch chan<- prometheus.Metric) {
+	ch <- e.queryInfo
+	ch <- e.up
+	ch <- e.scrapeComplete
+	ch <- e.circuitOpen
+	ch <- e.scrapeInProgress
+	ch <- e.collectWaiters
+	ch <- e.assetsScraped
+	ch <- e.scrapePages
+	ch <- e.assetsTruncated
+	ch <- e.partialScrapes
+	ch <- e.failedPages
+	ch <- e.scrapesTotal
+	ch <- e.scrapeFailures
+	ch <- e.scrapesSkipped
+	ch <- e.scrapeRetries
+	ch <- e.hardwareFailures
+	ch <- e.duplicateTags
+	e.scrapeError.Collect(ch)
 	ch <- e.scrapeDuration
+	ch <- e.scrapeDurationEMA
+	ch <- e.scrapeDurations
+	ch <- e.pageDurations
+	ch <- e.lastScrapeTimestamp
+	ch <- e.lastSuccessTimestamp
+}
+
+// getAssets retrieves the assets to export from Collins. In incremental mode,
+// it only requests the assets updated since the start of the last successful
+// scrape, merges them into the retained assets, and returns all of those,
+// ordered by their ID. Every FullRefreshInterval, and until the first full
+// scrape succeeds, all assets are requested and replace the retained ones
+// instead. start is the start of the current scrape.
+func (e *Exporter) getAssets(ctx context.Context, start time.Time) (assetPages, error) {
+	if !e.config.Incremental {
+		return e.getAllAssets(ctx, time.Time{})
+	}
+	full := e.retainedAssets == nil || time.Since(e.lastFullRefresh) >= e.config.FullRefreshInterval
+	since := e.updatedSince
+	if full {
+		since = time.Time{}
+	}
+	result, err := e.getAllAssets(ctx, since)
+	if full {
+		// A failed full scrape must not drop the retained assets.
+		if err != nil {
+			return result, err
+		}
+		e.retainedAssets = make(map[string]collins.Asset, len(result.assets))
+		e.lastFullRefresh = start
+	} else {
+		log.Debugf("Merging %d assets updated since %v", len(result.assets), since)
+	}
+	for _, asset := range result.assets {
+		e.retainedAssets[asset.Metadata.Tag] = asset
+	}
+	// Assets updated during a failed scrape are requested again by the
+	// next one.
+	if err == nil {
+		e.updatedSince = start
+	}
+	merged := make([]collins.Asset, 0, len(e.retainedAssets))
+	for _, asset := range e.retainedAssets {
+		merged = append(merged, asset)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Metadata.ID < merged[j].Metadata.ID
+	})
+	result.assets = merged
+	return result, err
+}
+
+// assetPages are the assets retrieved from Collins page by page, along with
+// the numbers of the pages that could not be retrieved, in increasing order.
+type assetPages struct {
+	assets      []collins.Asset
+	failedPages []int
 }
 
-// getAllAssets retrieves the asset data from collins and returns it. It returns
-// any encountered error. Even if the returned error is not nil, there might be
-// assets in the returned slice if the error was only encountered midway during
-// the reterieval.
-func getAllAssets(client *collins.Client) ([]collins.Asset, error) {
+// getAllAssets retrieves the asset data matching the configured CQL query from
+// collins and returns it. If since is not the zero time, only the assets
+// updated after it are retrieved. After the first page, which tells us the total number
+// of assets, the remaining pages are retrieved with the configured concurrency,
+// or one after the other in cursor mode.
+// Failed requests are retried as configured. getAllAssets returns the error of
+// the first page that failed. Even if the returned error is not nil, there
+// might be assets in the result, namely those from all pages that did not
+// fail, whose numbers are in the result as well. Once ctx is done, no further
+// pages are requested.
+func (e *Exporter) getAllAssets(ctx context.Context, since time.Time) (assetPages, error) {
 
+	// Collins sorts the assets by ID, which is stable across pages as long
+	// as no assets are deleted during the scrape. go-collins only allows
+	// setting the sort direction, not the field. Assets appearing on two
+	// pages anyway are dropped by dedupTags.
 	opts := collins.AssetFindOpts{
-		Query:    "TYPE = SERVER_NODE AND NOT STATUS = incomplete",
-		PageOpts: collins.PageOpts{Page: 0, Size: 1000},
+		Query:    e.config.Query,
+		PageOpts: collins.PageOpts{Page: 0, Size: e.config.PageSize, Sort: "ASC"},
+	}
+	if !since.IsZero() {
+		// Collins timestamps are in UTC.
+		updatedAfter := iso8601.New(since.UTC())
+		opts.UpdatedAfter = &updatedAfter
 	}
 
-	assets, resp, err := client.Assets.Find(&opts)
+	assets, resp, err := e.findAssets(ctx, &opts)
 	if err != nil {
 		log.Errorf("Assets.Find returned error: %s", err)
-		return nil, err
+		e.scrapePages.Set(0)
+		return assetPages{failedPages: []int{0}}, err
 	}
 	log.Debugf("Found %d assets, %d total", len(assets), resp.TotalResults)
 
-	allAssets := make([]collins.Asset, 0, resp.TotalResults)
-	allAssets = append(allAssets, assets...)
+	total := resp.TotalResults
+	if e.config.MaxAssets > 0 && total > e.config.MaxAssets {
+		log.Warnf("Query matches %d assets, only retrieving the first %d", total, e.config.MaxAssets)
+		total = e.config.MaxAssets
+		e.assetsTruncated.Set(1)
+		if len(assets) > total {
+			assets = assets[:total]
+		}
+	} else {
+		e.assetsTruncated.Set(0)
+	}
+
+	pages := (total + opts.PageOpts.Size - 1) / opts.PageOpts.Size
+	if pages <= 1 {
+		e.scrapePages.Set(1)
+		return assetPages{assets: assets}, nil
+	}
+	if e.config.PaginationMode == paginationCursor {
+		return e.getAssetsByCursor(ctx, opts, assets, total)
+	}
 
-	for opts.PageOpts.Page++; resp.NextPage > resp.CurrentPage; opts.PageOpts.Page++ {
-		assets, resp, err = client.Assets.Find(&opts)
+	// Each worker writes only to the elements of the page it is fetching,
+	// so no locking is required.
+	var (
+		pageAssets = make([][]collins.Asset, pages)
+		pageErrs   = make([]error, pages)
+		pageCh     = make(chan int)
+		wg         sync.WaitGroup
+	)
+	pageAssets[0] = assets
+
+	for i := 0; i < e.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pageCh {
+				if err := ctx.Err(); err != nil {
+					pageErrs[page] = err
+					continue
+				}
+				pageOpts := opts
+				pageOpts.PageOpts.Page = page
+				assets, _, err := e.findAssets(ctx, &pageOpts)
+				if err != nil {
+					log.Errorf("Assets.Find for page %d returned error: %s", page, err)
+					pageErrs[page] = err
+					continue
+				}
+				log.Debugf("Found %d more assets on page %d", len(assets), page)
+				pageAssets[page] = assets
+			}
+		}()
+	}
+	for page := 1; page < pages; page++ {
+		pageCh <- page
+	}
+	close(pageCh)
+	wg.Wait()
+
+	fetched := 0
+	for _, err := range pageErrs {
+		if err == nil {
+			fetched++
+		}
+	}
+	e.scrapePages.Set(float64(fetched))
+
+	// err is nil here, so that it holds the error of the first failed
+	// page below.
+	result := assetPages{assets: make([]collins.Asset, 0, total)}
+	for page, assets := range pageAssets {
+		if pageErrs[page] != nil {
+			result.failedPages = append(result.failedPages, page)
+			if err == nil {
+				err = pageErrs[page]
+			}
+			continue
+		}
+		result.assets = append(result.assets, assets...)
+	}
+	if len(result.assets) > total {
+		result.assets = result.assets[:total]
+	}
+
+	return result, err
+}
+
+// getAssetsByCursor retrieves the assets matching opts following those of the
+// first page, assets, until total assets are retrieved or a page is short.
+// Collins answers requests for deep pages more slowly than for the first ones,
+// so instead of requesting the pages by their number, it requests the first
+// page of the assets with an ID above that of the last asset retrieved so far.
+// Since each page depends on the previous one, the pages are retrieved one
+// after the other. If a page fails, the assets of the previous pages are
+// returned along with its error.
+func (e *Exporter) getAssetsByCursor(ctx context.Context, opts collins.AssetFindOpts, assets []collins.Asset, total int) (assetPages, error) {
+	result := assetPages{assets: make([]collins.Asset, 0, total)}
+	result.assets = append(result.assets, assets...)
+	page := 1
+	for ; len(assets) == opts.PageOpts.Size && len(result.assets) < total; page++ {
+		pageOpts := opts
+		pageOpts.Query = cursorQuery(opts.Query, result.assets[len(result.assets)-1].Metadata.ID)
+		var err error
+		assets, _, err = e.findAssets(ctx, &pageOpts)
+		if err != nil {
+			log.Errorf("Assets.Find for page %d (query %q) returned error: %s", page, pageOpts.Query, err)
+			e.scrapePages.Set(float64(page))
+			result.failedPages = []int{page}
+			return result, err
+		}
+		log.Debugf("Found %d more assets on page %d", len(assets), page)
+		result.assets = append(result.assets, assets...)
+	}
+	e.scrapePages.Set(float64(page))
+	if len(result.assets) > total {
+		result.assets = result.assets[:total]
+	}
+	return result, nil
+}
+
+// cursorQuery returns a CQL query selecting the assets matching query with an
+// ID above lastID.
+func cursorQuery(query string, lastID int) string {
+	cursor := fmt.Sprintf("ID = [%d, *]", lastID+1)
+	if query == "" {
+		return cursor
+	}
+	return "(" + query + ") AND " + cursor
+}
+
+// getFlaggedTags retrieves the assets matching the configured flag query from
+// Collins page by page and returns the set of their tags. Failed requests are
+// retried as configured.
+func (e *Exporter) getFlaggedTags(ctx context.Context) (map[string]bool, error) {
+	opts := collins.AssetFindOpts{
+		Query:    e.config.FlagQuery,
+		PageOpts: collins.PageOpts{Page: 0, Size: e.config.PageSize, Sort: "ASC"},
+	}
+	flagged := map[string]bool{}
+	for {
+		assets, resp, err := e.findAssets(ctx, &opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, asset := range assets {
+			flagged[asset.Metadata.Tag] = true
+		}
+		opts.PageOpts.Page++
+		if len(assets) < opts.PageOpts.Size || opts.PageOpts.Page*opts.PageOpts.Size >= resp.TotalResults {
+			log.Debugf("Found %d assets matching the flag query", len(flagged))
+			return flagged, nil
+		}
+	}
+}
+
+// assetQuery builds a CQL query selecting the assets of the given type. If
+// include is not empty, only assets with one of its statuses are selected.
+// Otherwise, incomplete assets are not selected. Assets with one of the
+// statuses in exclude are never selected.
+func assetQuery(assetType string, include, exclude []string) (string, error) {
+	if assetType == "" {
+		assetType = defaultAssetType
+	}
+	known := false
+	for _, t := range assetTypes {
+		known = known || t == assetType
+	}
+	if !known {
+		return "", fmt.Errorf("unknown asset type %q, must be one of %s", assetType, strings.Join(assetTypes, ", "))
+	}
+	clauses := []string{"TYPE = " + assetType}
+
+	included := map[string]bool{}
+	var includeClauses []string
+	for _, status := range include {
+		name, err := statusName(status)
 		if err != nil {
-			log.Errorf("Assets.Find returned error: %s", err)
+			return "", err
+		}
+		included[name] = true
+		includeClauses = append(includeClauses, "STATUS = "+strings.ToLower(name))
+	}
+	if len(includeClauses) > 0 {
+		clauses = append(clauses, "("+strings.Join(includeClauses, " OR ")+")")
+	} else {
+		exclude = append([]string{"Incomplete"}, exclude...)
+	}
+
+	excluded := map[string]bool{}
+	for _, status := range exclude {
+		name, err := statusName(status)
+		if err != nil {
+			return "", err
+		}
+		if included[name] {
+			return "", fmt.Errorf("status %s cannot be both included and excluded", name)
+		}
+		if !excluded[name] {
+			excluded[name] = true
+			clauses = append(clauses, "NOT STATUS = "+strings.ToLower(name))
+		}
+	}
+	return strings.Join(clauses, " AND "), nil
+}
+
+// statusName returns the name of the Collins status given in any case.
+func statusName(status string) (string, error) {
+	for _, name := range statusNames {
+		if strings.EqualFold(name, status) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown status %q, must be one of %s", status, strings.Join(statusNames, ", "))
+}
+
+// knownStatus returns whether the given status is one of statusNames.
+func knownStatus(status string) bool {
+	for _, name := range statusNames {
+		if name == status {
+			return true
+		}
+	}
+	return false
+}
+
+// scrapeErrorReasons are the values of the reason label of the scrape_error
+// metric.
+var scrapeErrorReasons = []string{"config", "breaker", "timeout", "network", "auth", "http", "parse"}
+
+// scrapeErrorReason returns the category of the error of a failed scrape of
+// Collins, except for errors setting up the client, which are categorized as
+// "config" by the caller.
+func scrapeErrorReason(err error) string {
+	if err == errBreakerOpen {
+		return "breaker"
+	}
+	if err == context.DeadlineExceeded {
+		return "timeout"
+	}
+	switch err := err.(type) {
+	case *collins.Error:
+		// The message starts with the HTTP status, e.g. "401 Unauthorized".
+		if strings.HasPrefix(err.Data.Message, "401 ") || strings.HasPrefix(err.Data.Message, "403 ") {
+			return "auth"
+		}
+		return "http"
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	// All other errors result from responses which could not be decoded.
+	return "parse"
+}
+
+// errBreakerOpen is returned by checkBreaker while Collins is not scraped.
+var errBreakerOpen = errors.New("too many consecutive failures, not scraping Collins")
+
+// checkBreaker returns errBreakerOpen if Collins should not be scraped because
+// the configured number of consecutive scrapes failed and the cooldown has
+// not passed yet. Once it has passed, Collins is only scraped if a single
+// lightweight request succeeds. Otherwise, the error of that request is
+// returned.
+func (e *Exporter) checkBreaker() error {
+	if e.config.BreakerThreshold <= 0 || e.consecutiveFailures < e.config.BreakerThreshold {
+		return nil
+	}
+	if time.Now().Before(e.breakerOpenUntil) {
+		return errBreakerOpen
+	}
+	if _, err := e.Check(); err != nil {
+		log.Errorf("Collins is still failing: %s", err)
+		return err
+	}
+	log.Infoln("Collins is reachable again, resuming scrapes")
+	return nil
+}
+
+// Check verifies that Collins can be reached with the configured credentials
+// and accepts the configured query by retrieving a single asset. It returns
+// the total number of assets matching the query.
+func (e *Exporter) Check() (int, error) {
+	if err := e.setupClient(); err != nil {
+		return 0, err
+	}
+	_, resp, err := e.finder.Find(&collins.AssetFindOpts{
+		Query:    e.config.Query,
+		PageOpts: collins.PageOpts{Size: 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.TotalResults, nil
+}
+
+// retryBackoff is the time to wait before the first retry of a failed
+// request. It doubles with each further retry.
+const retryBackoff = 500 * time.Millisecond
+
+// findAssets calls Assets.Find, retrying up to the configured number of times
+// with exponential backoff on network errors, server-side errors, and rate
+// limiting by Collins (429). Other client-side errors (4xx) and malformed
+// responses are not retried. No request is started and no retry is waited for
+// once ctx is done.
+func (e *Exporter) findAssets(ctx context.Context, opts *collins.AssetFindOpts) ([]collins.Asset, *collins.Response, error) {
+	backoff := retryBackoff
+	for retry := 0; ; retry++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		start := time.Now()
+		assets, resp, err := e.finder.Find(opts)
+		e.pageDurations.Observe(time.Since(start).Seconds())
+		if err == nil || retry >= e.config.Retries || !retryable(resp) {
+			return assets, resp, err
+		}
+		// In cursor mode, the page is always 0, and the query tells
+		// the pages apart.
+		log.Warnf("Assets.Find for page %d of query %q returned error, retrying in %v: %s", opts.PageOpts.Page, opts.Query, backoff, err)
+		e.scrapeRetries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns whether a failed request with the given response is worth
+// retrying. A nil response indicates a network error. Responses with status
+// 429 indicate that Collins is rate limiting the exporter, which the backoff of
+// the retries helps with.
+func retryable(resp *collins.Response) bool {
+	return resp == nil || resp.Response == nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// forEachAsset calls fn for each of the given assets, running at most
+// concurrency calls at a time, and waits for them to return. fn may modify the
+// asset it is called with, but must synchronize access to anything else. Once
+// ctx is done, fn is not called for further assets, and ctx.Err() is returned.
+func forEachAsset(ctx context.Context, assets []collins.Asset, concurrency int, fn func(asset *collins.Asset)) error {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+		err error
+	)
+	for i := range assets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err = ctx.Err(); err != nil {
 			break
 		}
-		log.Debugf("Found %d more assets", len(assets))
+		wg.Add(1)
+		go func(asset *collins.Asset) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(asset)
+		}(&assets[i])
+	}
+	wg.Wait()
+	return err
+}
+
+// parseWatts parses a power draw like "1,200 W" or "1.2kW" into watts. Commas
+// are taken as thousands separators.
+func parseWatts(s string) (float64, error) {
+	v := strings.ToLower(strings.Replace(strings.TrimSpace(s), ",", "", -1))
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(v, "kw"):
+		v, scale = strings.TrimSuffix(v, "kw"), 1000
+	case strings.HasSuffix(v, "watts"):
+		v = strings.TrimSuffix(v, "watts")
+	case strings.HasSuffix(v, "w"):
+		v = strings.TrimSuffix(v, "w")
+	}
+	watts, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid power draw %q", s)
+	}
+	return watts * scale, nil
+}
+
+// attributeMetrics creates the attributes metrics of the given asset, one per
+// attribute in the whitelist, or per attribute if the whitelist is empty. tag is
+// the value of the tag label. Attributes the asset does not have are omitted.
+func (e *Exporter) attributeMetrics(asset collins.Asset, tag string) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	if len(e.config.AttributeWhitelist) == 0 {
+		keys := make([]string, 0, len(asset.Attributes["0"]))
+		for key := range asset.Attributes["0"] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetAttributesDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, key, asset.Attributes["0"][key],
+			))
+		}
+		return metrics
+	}
+	for _, key := range e.config.AttributeWhitelist {
+		if value, ok := asset.Attributes["0"][key]; ok {
+			metrics = append(metrics, prometheus.MustNewConstMetric(
+				e.assetAttributesDesc,
+				prometheus.GaugeValue,
+				1,
+				tag, key, value,
+			))
+		}
+	}
+	return metrics
+}
+
+// assetAttribute returns the value of the Collins attribute with the given key
+// for the given asset, or the empty string if the asset does not have the
+// attribute. Collins stores attribute keys in upper case.
+func assetAttribute(asset collins.Asset, key string) string {
+	return asset.Attributes["0"][strings.ToUpper(key)]
+}
+
+// validNamespace returns whether the given string is a valid prefix of
+// Prometheus metric names.
+func validNamespace(s string) bool {
+	for i, b := range []byte(s) {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_' || b == ':' || i > 0 && b >= '0' && b <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLabelName turns the given Collins attribute key into a valid
+// Prometheus label name by lowercasing it and replacing invalid characters by
+// underscores.
+func sanitizeLabelName(key string) (string, error) {
+	name := []byte(strings.ToLower(key))
+	for i, b := range name {
+		if !(b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '_') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "", errors.New("empty attribute key")
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		name = append([]byte{'_'}, name...)
+	}
+	if strings.HasPrefix(string(name), "__") {
+		return "", fmt.Errorf("label name %q for attribute %q is reserved", name, key)
+	}
+	return string(name), nil
+}
+
+// parseTimestamp converts a Collins timestamp into seconds since the Unix
+// epoch. Collins returns timestamps in ISO 8601 format without a time zone,
+// which is interpreted as UTC. Timestamps with a time zone are accepted, too.
+func parseTimestamp(s string) (float64, error) {
+	if s == "" {
+		return 0, errors.New("empty timestamp")
+	}
+	t, err := time.Parse(iso8601.Format, s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("malformed timestamp %q", s)
+	}
+	return float64(t.UnixNano()) / 1e9, nil
+}
+
+// timestampedMetric is a prometheus.Metric with an explicit timestamp. The
+// vendored client library lacks prometheus.NewMetricWithTimestamp.
+type timestampedMetric struct {
+	prometheus.Metric
+	t time.Time
+}
+
+// Write implements prometheus.Metric.
+func (m timestampedMetric) Write(pb *dto.Metric) error {
+	err := m.Metric.Write(pb)
+	pb.TimestampMs = proto.Int64(m.t.UnixNano() / int64(time.Millisecond))
+	return err
+}
+
+// endpointName derives the name of a Collins endpoint from the path of its
+// config file, e.g. "us-east" for "/etc/collins/us-east.yml".
+func endpointName(file string) string {
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// stringSlice is a flag.Value collecting the values of a repeatable flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
 
-		allAssets = append(allAssets, assets...)
+// parseTagPatterns parses a list of regular expressions matching asset tags.
+// If s is the path of an existing file, the file contains one expression per
+// line, ignoring empty lines and lines starting with #. Otherwise, s is a
+// comma-separated list of expressions. The expressions are anchored at both
+// ends.
+func parseTagPatterns(s string) ([]*regexp.Regexp, error) {
+	var exprs []string
+	if s == "" {
+		return nil, nil
+	} else if content, err := ioutil.ReadFile(s); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				exprs = append(exprs, line)
+			}
+		}
+	} else if os.IsNotExist(err) {
+		exprs = splitList(s)
+	} else {
+		return nil, err
 	}
 
-	return allAssets, err
+	patterns := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// parseBuckets parses a comma-separated list of histogram bucket boundaries.
+// The boundaries must be in increasing order.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket boundary %q: %s", f, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket boundaries must be increasing, got %v after %v", b, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
 }
 
 func main() {
+	var detailAttributes, numericAttributes, includeStatuses, excludeStatuses stringSlice
+	flag.Var(&numericAttributes, "collins.numeric-attribute", "Collins attribute to export as the metric asset_attr_<name>, given as KEY=name or KEY, which uses the lowercased key as name. Can be repeated.")
+	flag.Var(&detailAttributes, "collins.detail-attribute", "Key of a Collins attribute to add as a label to the details metric. Can be repeated.")
+	flag.Var(&includeStatuses, "collins.include-statuses", "Status of the assets to export if no query is set. Can be repeated. Defaults to all statuses except Incomplete.")
+	flag.Var(&excludeStatuses, "collins.exclude-statuses", "Status of assets not to export if no query is set. Can be repeated.")
 	var (
-		listenAddress = flag.String("web.listen-address", ":9136", "Address to listen on for web interface and telemetry.")
+		showVersion   = flag.Bool("version", false, "Print version information and exit.")
+		check         = flag.Bool("check", false, "Check the configuration and the connection to Collins, then exit.")
+		once          = flag.Bool("once", false, "Scrape Collins once, write the metrics to stdout in the Prometheus text format, then exit.")
+		listenAddress = flag.String("web.listen-address", ":9136", "Address to listen on for web interface and telemetry, or unix:<path> to listen on a Unix socket.")
+		adminAddress  = flag.String("web.admin-listen-address", "", "Address to serve the health, readiness, reload, and profiling endpoints on instead of -web.listen-address, e.g. localhost:9137, or unix:<path> to listen on a Unix socket.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		collinsConfig = flag.String("collins.config", "", "Path to Collins config (https://tumblr.github.io/collins/tools.html#configs). Defaults to common locations.")
+		readyMaxAge   = flag.Duration("web.ready-max-age", 5*time.Minute, "Maximum age of the last successful Collins scrape for the exporter to be considered ready.")
+		gracePeriod   = flag.Duration("web.shutdown-grace-period", 10*time.Second, "Time to wait for in-flight requests to complete upon shutdown.")
+		webConfigFile = flag.String("web.config.file", "", "Path to a web configuration file enabling TLS and basic authentication. If empty, plain HTTP is served.")
+		metricNS      = flag.String("metric.namespace", defaultNamespace, "Prefix of the names of all exported metrics.")
+		pageTitle     = flag.String("web.page-title", "Collins Exporter", "Title of the landing page.")
+		enablePprof   = flag.Bool("web.enable-pprof", false, "Serve the Go profiling endpoints under /debug/pprof/.")
+		probeOnly     = flag.Bool("web.probe-only", false, "Only scrape Collins instances given by the target parameter of /probe. The metrics endpoint then only serves metrics about the exporter itself. Requires -web.probe-targets.")
+		probeTargets  = flag.String("web.probe-targets", "", "Comma-separated Collins config files or URLs that may be given as the target parameter of /probe. If empty, /probe is not served.")
+		probeConc     = flag.Int("web.probe-concurrency", 4, "Maximum number of /probe requests served concurrently. Further requests wait for their turn.")
+		collinsConfig = flag.String("collins.config", "", "Path to Collins config (https://tumblr.github.io/collins/tools.html#configs). Defaults to common locations. A comma-separated list of paths scrapes multiple Collins instances.")
+		collinsHost   = flag.String("collins.host", "", "URL of Collins, e.g. https://collins.example.com. Requires -collins.user and -collins.password and takes precedence over the COLLINS_* environment variables. Cannot be combined with -collins.config or -collins.profile.")
+		collinsUser   = flag.String("collins.user", "", "Username for Collins if -collins.host is set.")
+		collinsPass   = flag.String("collins.password", "", "Password for Collins if -collins.host is set. Visible to other users of the host, so only use this for testing.")
+		profile       = flag.String("collins.profile", "", "Profile of the Collins config to use, for config files mapping profile names to the host and credentials of several Collins instances.")
+		collinsQuery  = flag.String("collins.query", "", "CQL query selecting the assets to export. If empty, all assets of -collins.asset-type which are not incomplete are exported.")
+		flagQuery     = flag.String("collins.flag-query", "", "CQL query selecting the assets to flag among those exported. If empty, no assets are flagged.")
+		assetType     = flag.String("collins.asset-type", "", "Type of the assets to export if no query is set, e.g. SWITCH. Defaults to "+defaultAssetType+".")
+		collectHW     = flag.Bool("collins.collect-hardware", false, "Retrieve the hardware details of each asset. This requires one additional Collins request per asset.")
+		hardwareConc  = flag.Int("collins.hardware-concurrency", 10, "Maximum number of concurrent requests retrieving the hardware of assets.")
+		collectPower  = flag.Bool("collins.collect-power", false, "Query the power status of each asset. This requires one additional Collins request per asset.")
+		powerConc     = flag.Int("collins.power-concurrency", 10, "Maximum number of concurrent power status queries.")
+		collectLogs   = flag.Bool("collins.collect-logs", false, "Retrieve the most recent logs of each asset. This requires one additional Collins request per asset.")
+		logLimit      = flag.Int("collins.log-limit", 20, "Maximum number of most recent logs to retrieve per asset.")
+		logMaxAge     = flag.Duration("collins.log-max-age", 24*time.Hour, "Maximum age of the logs to count. Zero means no limit.")
+		logConc       = flag.Int("collins.log-concurrency", 10, "Maximum number of concurrent requests retrieving the logs of assets.")
+		primaryPool   = flag.String("collins.primary-address-pool", "", "Collins address pool of the address exported as the primary address of an asset. If empty, or if an asset has no address in the pool, its first address is used.")
+		powerWatts    = flag.String("collins.power-watts-attribute", "POWER_WATTS", "Collins attribute holding the power draw of an asset in watts. If empty, the power draw is not exported.")
+		probeIPMI     = flag.Bool("collins.probe-ipmi", false, "Check whether the IPMI address of each asset accepts TCP connections.")
+		ipmiPort      = flag.Int("collins.probe-ipmi-port", 443, "TCP port to probe on IPMI addresses.")
+		ipmiTimeout   = flag.Duration("collins.probe-ipmi-timeout", time.Second, "Timeout of each IPMI probe.")
+		ipmiConc      = flag.Int("collins.probe-ipmi-concurrency", 50, "Maximum number of concurrent IPMI probes.")
+		redactIPMI    = flag.Bool("collins.redact-ipmi", false, "Replace the IPMI address in the ipmi_address label of the details metric by \""+redactedIPMIAddress+"\".")
+		exportAttrs   = flag.Bool("collins.export-attributes", false, "Export the Collins attributes of each asset in the key and value labels of the attributes metric.")
+		attrWhitelist = flag.String("collins.attribute-whitelist", "", "Comma-separated keys of the Collins attributes to export if -collins.export-attributes is set. If empty, all attributes are exported.")
+		typeLabel     = flag.Bool("collins.export-type-label", false, "Add the type label with the asset type to the status, state, and details metrics.")
+		lowercaseTags = flag.Bool("collins.lowercase-tags", false, "Lowercase the tag label of all asset metrics.")
+		stateAge      = flag.String("collins.state-age-statuses", "Incomplete,New,Provisioning", "Comma-separated statuses for which to export the time since the last update of an asset.")
+		assetTimes    = flag.Bool("collins.use-asset-timestamps", false, "Attach the time of the last update of each asset in Collins to its metrics. Prometheus drops samples with timestamps too far in the past.")
+		intake        = flag.String("collins.intake-statuses", "Incomplete,New", "Comma-separated statuses of assets going through intake, for which to export the time since the creation of an asset and the number of assets.")
+		maxAssets     = flag.Int("collins.max-assets", 0, "Maximum number of assets to retrieve per Collins scrape. Further assets are ignored. Zero means no limit.")
+		pageSize      = flag.Int("collins.page-size", 1000, "Number of assets to retrieve from Collins per request.")
+		pagination    = flag.String("collins.pagination-mode", paginationPage, "How to retrieve the pages of assets from Collins: \"page\" requests the pages by their number, concurrently, \"cursor\" requests the assets following the last one retrieved so far, one page after the other.")
+		retries       = flag.Int("collins.retries", 3, "Number of times to retry a failed Collins request on network or server errors.")
+		concurrency   = flag.Int("collins.concurrency", 4, "Maximum number of asset pages to retrieve from Collins concurrently.")
+		timeout       = flag.Duration("collins.timeout", time.Minute, "Timeout for each request to Collins, including reading the response. Zero means no timeout.")
+		breakerThresh = flag.Int("collins.breaker-threshold", 0, "Number of consecutive failed Collins scrapes after which Collins is not scraped for -collins.breaker-cooldown. Zero disables the circuit breaker.")
+		breakerCool   = flag.Duration("collins.breaker-cooldown", 5*time.Minute, "Time for which Collins is not scraped once -collins.breaker-threshold is reached.")
+		allowPartial  = flag.Bool("collins.allow-partial", false, "Export the assets retrieved by a Collins scrape even if retrieving further assets failed.")
+		scrapeTimeout = flag.Duration("collins.scrape-timeout", 0, "Time after which a Collins scrape is abandoned. Zero means no timeout.")
+		caFile        = flag.String("collins.ca-file", "", "Path to a PEM file with the CA certificates to verify the certificate of Collins. Defaults to the system CAs.")
+		rateLimit     = flag.Float64("collins.rate-limit", 0, "Maximum number of requests to Collins per second. Zero means no limit.")
+		maxIdle       = flag.Int("collins.max-idle-conns", defaultMaxIdleConns, "Maximum number of idle connections to Collins kept for reuse.")
+		maxIdlePerHst = flag.Int("collins.max-idle-conns-per-host", defaultMaxIdleConnsPerHost, "Maximum number of idle connections per Collins host kept for reuse.")
+		idleTimeout   = flag.Duration("collins.idle-conn-timeout", defaultIdleConnTimeout, "Time after which idle connections to Collins are closed.")
+		userAgent     = flag.String("collins.user-agent", defaultUserAgent(), "User-Agent header of the requests to Collins.")
+		insecure      = flag.Bool("collins.insecure-skip-verify", false, "Disable the verification of the certificate of Collins. Only use this for testing.")
+		jitter        = flag.Duration("collins.scrape-jitter", 0, "Maximum random delay of the first scrape if -collins.scrape-interval is set. Must not exceed the scrape interval.")
+		warmUp        = flag.Bool("collins.warm-up", true, "Scrape Collins on startup, so that the first scrape of the exporter is served right away. Only applies if -collins.scrape-interval is not set.")
+		incremental   = flag.Bool("collins.incremental", false, "Only request the assets updated since the last successful scrape and merge them into the assets of earlier scrapes.")
+		fullRefresh   = flag.Duration("collins.full-refresh-interval", time.Hour, "Interval in which Collins is scraped in full if -collins.incremental is set, dropping assets no longer matching the query.")
+		cacheTTL      = flag.Duration("collins.cache-ttl", 0, "Time for which the result of a Collins scrape is served without scraping Collins again.")
+		buckets       = flag.String("collins.scrape-duration-buckets", "", "Comma-separated bucket boundaries in seconds of the scrape duration histogram. Defaults to 1,2.5,5,10,20,30,60,120,300.")
+		tagAllow      = flag.String("collins.tag-allow", "", "Comma-separated regular expressions, or the path of a file with one per line, matching the tags of the assets to export. If empty, all assets are exported.")
+		tagDeny       = flag.String("collins.tag-deny", "", "Comma-separated regular expressions, or the path of a file with one per line, matching the tags of the assets not to export. Takes precedence over -collins.tag-allow.")
+		smoothing     = flag.Float64("collins.scrape-duration-smoothing", defaultScrapeDurationSmoothing, "Weight in (0, 1] of the latest scrape duration in the exponential moving average of the scrape durations.")
+		stateRefresh  = flag.Duration("collins.state-refresh-interval", time.Hour, "Interval in which to refresh the list of Collins states.")
+		interval      = flag.Duration("collins.scrape-interval", 0, "Interval in which to scrape Collins in the background. If zero, Collins is scraped whenever the exporter is scraped.")
 	)
 	flag.Parse()
 
-	log.Infoln("Starting collins_exporter")
+	if *showVersion {
+		fmt.Println(version.Print("collins_exporter"))
+		os.Exit(0)
+	}
 
-	exporter := NewExporter(*collinsConfig)
-	go exporter.Loop()
-	prometheus.MustRegister(exporter)
+	log.Infoln("Starting collins_exporter", version.Info())
+	log.Infoln("Build context", version.BuildContext())
 
-	log.Infoln("Listening on", *listenAddress)
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Collins Exporter</title></head>
-             <body>
-             <h1>Collins Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
+	var scrapeDurationBuckets []float64
+	if *buckets != "" {
+		var err error
+		if scrapeDurationBuckets, err = parseBuckets(*buckets); err != nil {
+			log.Fatalf("Invalid -collins.scrape-duration-buckets: %s", err)
+		}
+	}
+
+	tagAllowPatterns, err := parseTagPatterns(*tagAllow)
+	if err != nil {
+		log.Fatalf("Invalid -collins.tag-allow: %s", err)
+	}
+	tagDenyPatterns, err := parseTagPatterns(*tagDeny)
+	if err != nil {
+		log.Fatalf("Invalid -collins.tag-deny: %s", err)
+	}
+
+	if *insecure {
+		log.Warnln("Verification of the Collins certificate is disabled. Do not use this in production!")
+	}
+	transport, err := setupCollinsTransport(transportConfig{
+		Namespace:           *metricNS,
+		Timeout:             *timeout,
+		CAFile:              *caFile,
+		InsecureSkipVerify:  *insecure,
+		UserAgent:           *userAgent,
+		RateLimit:           *rateLimit,
+		MaxIdleConns:        *maxIdle,
+		MaxIdleConnsPerHost: *maxIdlePerHst,
+		IdleConnTimeout:     *idleTimeout,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalf("Could not set up Collins transport: %s", err)
+	}
+
+	credentials := collinsCredentials{
+		Host:     *collinsHost,
+		Username: *collinsUser,
+		Password: *collinsPass,
+	}
+	baseConfig := Config{
+		Namespace:               *metricNS,
+		Profile:                 *profile,
+		Credentials:             credentials,
+		Transport:               transport,
+		Query:                   *collinsQuery,
+		FlagQuery:               *flagQuery,
+		AssetType:               *assetType,
+		IncludeStatuses:         includeStatuses,
+		ExcludeStatuses:         excludeStatuses,
+		CollectHardware:         *collectHW,
+		HardwareConcurrency:     *hardwareConc,
+		CollectPower:            *collectPower,
+		PowerConcurrency:        *powerConc,
+		CollectLogs:             *collectLogs,
+		LogLimit:                *logLimit,
+		LogMaxAge:               *logMaxAge,
+		LogConcurrency:          *logConc,
+		PowerWattsAttribute:     *powerWatts,
+		PrimaryAddressPool:      *primaryPool,
+		ProbeIPMI:               *probeIPMI,
+		IPMIProbePort:           *ipmiPort,
+		IPMIProbeTimeout:        *ipmiTimeout,
+		IPMIProbeConcurrency:    *ipmiConc,
+		DetailAttributes:        detailAttributes,
+		NumericAttributes:       numericAttributes,
+		TagAllow:                tagAllowPatterns,
+		TagDeny:                 tagDenyPatterns,
+		MaxAssets:               *maxAssets,
+		PageSize:                *pageSize,
+		PaginationMode:          *pagination,
+		LowercaseTags:           *lowercaseTags,
+		ExportTypeLabel:         *typeLabel,
+		ExportAttributes:        *exportAttrs,
+		AttributeWhitelist:      splitList(*attrWhitelist),
+		RedactIPMI:              *redactIPMI,
+		StateAgeStatuses:        splitList(*stateAge),
+		IntakeStatuses:          splitList(*intake),
+		UseAssetTimestamps:      *assetTimes,
+		Retries:                 *retries,
+		Concurrency:             *concurrency,
+		ScrapeInterval:          *interval,
+		CacheTTL:                *cacheTTL,
+		Incremental:             *incremental,
+		FullRefreshInterval:     *fullRefresh,
+		WarmUp:                  *warmUp,
+		ScrapeJitter:            *jitter,
+		AllowPartial:            *allowPartial,
+		BreakerThreshold:        *breakerThresh,
+		BreakerCooldown:         *breakerCool,
+		ScrapeTimeout:           *scrapeTimeout,
+		StateRefreshInterval:    *stateRefresh,
+		ScrapeDurationBuckets:   scrapeDurationBuckets,
+		ScrapeDurationSmoothing: *smoothing,
+	}
+
+	// Each probe target results in its own long-lived Exporter, so that
+	// probes share their scrape state.
+	targets := splitList(*probeTargets)
+	if *probeOnly && len(targets) == 0 {
+		log.Fatalln("-web.probe-only requires -web.probe-targets")
+	}
+	if *probeConc < 1 {
+		log.Fatalf("-web.probe-concurrency must be positive, got %d", *probeConc)
+	}
+	probeExporters, err := newProbeExporters(baseConfig, targets)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+
+	// Each Collins config results in its own Exporter, distinguished by the
+	// endpoint label if there is more than one.
+	collinsConfigs := strings.Split(*collinsConfig, ",")
+	if *probeOnly {
+		collinsConfigs = nil
+	}
+	exporters := make([]*Exporter, 0, len(collinsConfigs))
+	// The self-metrics go into the default registry along with those of
+	// the process, the asset metrics into their own.
+	selfRegistry, assetRegistry := prometheus.DefaultRegisterer, prometheus.NewRegistry()
+	checkFailed := false
+	endpoints := map[string]string{}
+	for _, file := range collinsConfigs {
+		config := baseConfig
+		config.CollinsConfig = file
+		if len(collinsConfigs) > 1 {
+			config.Endpoint = endpointName(file)
+			if other, ok := endpoints[config.Endpoint]; ok {
+				log.Fatalf("Collins configs %s and %s result in the same endpoint name %q", redactURL(other), redactURL(file), config.Endpoint)
+			}
+			endpoints[config.Endpoint] = file
+		}
+		exporter, err := NewExporter(config)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %s", err)
+		}
+		if *check {
+			name := redactURL(file)
+			if config.Credentials.isSet() {
+				name = config.Credentials.String()
+			} else if name == "" {
+				name = "default Collins config"
+			}
+			total, err := exporter.Check()
+			if err != nil {
+				fmt.Printf("%s: query %q failed: %s\n", name, exporter.config.Query, err)
+				checkFailed = true
+			} else {
+				fmt.Printf("%s: query %q matches %d assets\n", name, exporter.config.Query, total)
+			}
+			continue
+		}
+		if *once {
+			exporters = append(exporters, exporter)
+			continue
+		}
+		go exporter.Loop()
+		selfRegistry.MustRegister(exporter.SelfCollector())
+		assetRegistry.MustRegister(exporter.AssetCollector())
+		exporters = append(exporters, exporter)
+	}
+	if *check {
+		if checkFailed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *once {
+		ok, err := scrapeOnce(os.Stdout, exporters)
+		if err != nil {
+			log.Fatalf("Could not write metrics: %s", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(exporters) > 0 {
+		log.Infof("Using Collins query %q", exporters[0].config.Query)
+	}
+	probeExporterList := make([]*Exporter, 0, len(probeExporters))
+	for _, target := range targets {
+		exporter := probeExporters[target]
+		go exporter.Loop()
+		probeExporterList = append(probeExporterList, exporter)
+	}
+	prometheus.MustRegister(version.NewCollector("collins_exporter"))
+
+	// The net/http/pprof package registers its handlers on the default mux
+	// when imported, so the exporter serves its own mux instead. The admin
+	// and debug endpoints go to a separate mux if an admin address is set.
+	mux, adminMux := http.NewServeMux(), http.NewServeMux()
+	webEndpoints := []endpoint{{address: *listenAddress, handler: mux}}
+	if *adminAddress != "" {
+		webEndpoints = append(webEndpoints, endpoint{address: *adminAddress, handler: adminMux})
+	} else {
+		adminMux = mux
+	}
+	// The asset metrics are gathered first, so that the self-metrics
+	// reflect any scrape of Collins they initiated.
+	mux.Handle(*metricsPath, filterHandler(metricsHandler(prometheus.DefaultRegisterer, assetRegistry, prometheus.DefaultGatherer), exporters))
+	if len(probeExporters) > 0 {
+		mux.Handle("/probe", probeHandler(probeExporters, *probeConc))
+	}
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("OK\n"))
 	})
-	err := http.ListenAndServe(*listenAddress, nil)
+	adminMux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		for _, exporter := range exporters {
+			if !exporter.Ready(*readyMaxAge) {
+				http.Error(w, "Last Collins scrape failed or is too old.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("OK\n"))
+	})
+	adminMux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests are allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadClients(append(exporters[:len(exporters):len(exporters)], probeExporterList...)); err != nil {
+			log.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("OK\n"))
+	})
+	if *enablePprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	links := []string{
+		"<a href='" + html.EscapeString(*metricsPath) + "'>Metrics</a>",
+	}
+	if len(targets) > 0 {
+		links = append(links, "<a href='/probe?target="+html.EscapeString(url.QueryEscape(targets[0]))+"'>Probe "+html.EscapeString(targets[0])+"</a>")
+	}
+	adminLinks := []string{
+		"<a href='/healthz'>Health</a>",
+		"<a href='/-/ready'>Readiness</a>",
+	}
+	if *enablePprof {
+		adminLinks = append(adminLinks, "<a href='/debug/pprof/'>Profiling</a>")
+	}
+	if *adminAddress != "" {
+		adminMux.Handle("/", landingPageHandler(*pageTitle, adminLinks))
+	} else {
+		links = append(links, adminLinks...)
+	}
+	mux.Handle("/", landingPageHandler(*pageTitle, links))
+	for _, ep := range webEndpoints {
+		log.Infoln("Listening on", ep.address)
+	}
+	err = listenAndServe(webEndpoints, *webConfigFile, *gracePeriod)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// metricsHandler returns a handler serving the metrics of the given gatherers,
+// which are gathered in order, in the exposition format negotiated with the
+// request. The metrics about the handler itself are registered with reg.
+func metricsHandler(reg prometheus.Registerer, gatherers ...prometheus.Gatherer) http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		reg,
+		promhttp.HandlerFor(prometheus.Gatherers(gatherers), promhttp.HandlerOpts{}),
+	)
+}
+
+// landingPageHandler returns a handler serving a landing page with the given
+// title and links.
+func landingPageHandler(title string, links []string) http.Handler {
+	landingPage := []byte(`<html>
+             <head><title>` + html.EscapeString(title) + `</title></head>
+             <body>
+             <h1>` + html.EscapeString(title) + `</h1>
+             <p>` + strings.Join(links, "</p>\n             <p>") + `</p>
+             </body>
+             </html>`)
+	return gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(landingPage)
+	}))
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+)
+
+// fakeFinder is an AssetFinder serving assets from memory, page by page.
+type fakeFinder struct {
+	assets []collins.Asset
+	// failPages are the pages for which Find returns an error.
+	failPages map[int]bool
+	// failQueries are the queries for which Find returns an error.
+	failQueries map[string]bool
+	// If release is not nil, Find blocks until it is closed.
+	release chan struct{}
+
+	mtx   sync.Mutex
+	calls int
+	// requests are the page numbers and queries of the calls of Find so
+	// far.
+	requests []string
+}
+
+// cursorRE matches the condition of a query added in cursor mode.
+var cursorRE = regexp.MustCompile(`^\((.*)\) AND ID = \[(\d+), \*\]$`)
+
+// newFakeFinder returns a fakeFinder serving n assets of status Allocated.
+func newFakeFinder(n int) *fakeFinder {
+	f := &fakeFinder{}
+	for i := 1; i <= n; i++ {
+		f.assets = append(f.assets, collins.Asset{
+			Metadata: collins.Metadata{
+				ID:     i,
+				Tag:    fmt.Sprintf("tag%03d", i),
+				Status: "Allocated",
+			},
+		})
+	}
+	return f
+}
+
+// Find implements AssetFinder.
+func (f *fakeFinder) Find(opts *collins.AssetFindOpts) ([]collins.Asset, *collins.Response, error) {
+	f.mtx.Lock()
+	f.calls++
+	f.requests = append(f.requests, fmt.Sprintf("%d %s", opts.PageOpts.Page, opts.Query))
+	f.mtx.Unlock()
+	if f.release != nil {
+		<-f.release
+	}
+
+	page, size := opts.PageOpts.Page, opts.PageOpts.Size
+	if f.failPages[page] || f.failQueries[opts.Query] {
+		collinsErr := &collins.Error{}
+		collinsErr.Data.Message = "500 Internal Server Error returned from collins: failed"
+		return nil, &collins.Response{Response: &http.Response{StatusCode: http.StatusInternalServerError}}, collinsErr
+	}
+	assets := f.assets
+	if m := cursorRE.FindStringSubmatch(opts.Query); m != nil {
+		minID, _ := strconv.Atoi(m[2])
+		for len(assets) > 0 && assets[0].Metadata.ID < minID {
+			assets = assets[1:]
+		}
+	}
+	resp := &collins.Response{
+		Response:     &http.Response{StatusCode: http.StatusOK},
+		CurrentPage:  page,
+		TotalResults: len(assets),
+	}
+	start, end := page*size, (page+1)*size
+	if start > len(assets) {
+		start = len(assets)
+	}
+	if end > len(assets) {
+		end = len(assets)
+	}
+	return assets[start:end], resp, nil
+}
+
+// findCalls returns the number of calls of Find so far.
+func (f *fakeFinder) findCalls() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.calls
+}
+
+// collect returns the metrics collected by c.
+func collect(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func TestConcurrentCollect(t *testing.T) {
+	e, err := NewExporterWithFinder(Config{PageSize: 2, Concurrency: 2}, newFakeFinder(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+
+	const collectors = 100
+	var wg sync.WaitGroup
+	counts := make([]int, collectors)
+	for i := 0; i < collectors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			counts[i] = len(collect(e.AssetCollector()))
+			// The scrape metrics are written by the scrapes triggered by
+			// the other collections.
+			collect(e.SelfCollector())
+		}(i)
+	}
+	wg.Wait()
+
+	for i, n := range counts {
+		if n == 0 {
+			t.Errorf("collection %d got no metrics", i)
+		}
+		if n != counts[0] {
+			t.Errorf("collection %d got %d metrics, collection 0 got %d", i, n, counts[0])
+		}
+	}
+}
+
+func TestForEachAsset(t *testing.T) {
+	assets := newFakeFinder(20).assets
+	var (
+		mtx              sync.Mutex
+		running, maxConc int
+	)
+	err := forEachAsset(context.Background(), assets, 3, func(asset *collins.Asset) {
+		mtx.Lock()
+		running++
+		if running > maxConc {
+			maxConc = running
+		}
+		mtx.Unlock()
+		time.Sleep(time.Millisecond)
+		asset.Metadata.Label = "visited"
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, asset := range assets {
+		if asset.Metadata.Label != "visited" {
+			t.Errorf("asset %s was not visited", asset.Metadata.Tag)
+		}
+	}
+	if maxConc > 3 {
+		t.Errorf("got %d concurrent calls, want at most 3", maxConc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err = forEachAsset(ctx, assets, 1, func(asset *collins.Asset) {
+		mtx.Lock()
+		calls++
+		if calls == 5 {
+			cancel()
+		}
+		mtx.Unlock()
+	})
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if calls >= len(assets) {
+		t.Errorf("got %d calls after cancellation, want fewer than %d", calls, len(assets))
+	}
+}
+
+func TestStateAgeStatuses(t *testing.T) {
+	if _, err := NewExporterWithFinder(Config{PageSize: 1, StateAgeStatuses: []string{"Provisoning"}}, newFakeFinder(0)); err == nil {
+		t.Error("expected error for unknown state age status")
+	}
+	e, err := NewExporterWithFinder(Config{PageSize: 1, StateAgeStatuses: []string{"new", "NEW", "provisioning"}}, newFakeFinder(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(e.config.StateAgeStatuses), "[New Provisioning]"; got != want {
+		t.Errorf("got state age statuses %s, want %s", got, want)
+	}
+}
+
+func TestMetricsHandlerContentType(t *testing.T) {
+	e, err := NewExporterWithFinder(Config{PageSize: 10}, newFakeFinder(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e.AssetCollector(), e.SelfCollector())
+	handler := metricsHandler(prometheus.NewRegistry(), registry)
+
+	for _, test := range []struct {
+		accept string
+		want   string
+	}{
+		// The vendored client library predates OpenMetrics, so it is
+		// answered in the text format.
+		{accept: "", want: "text/plain; version=0.0.4; charset=utf-8"},
+		{accept: "application/openmetrics-text; version=0.0.1", want: "text/plain; version=0.0.4; charset=utf-8"},
+		{accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited", want: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Accept %q: got status %d, want %d", test.accept, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("Content-Type"); got != test.want {
+			t.Errorf("Accept %q: got Content-Type %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestMetricsHandlerGzip(t *testing.T) {
+	e, err := NewExporterWithFinder(Config{PageSize: 10}, newFakeFinder(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e.AssetCollector(), e.SelfCollector())
+	handler := metricsHandler(prometheus.NewRegistry(), registry)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "collins_asset_status{") {
+		t.Errorf("decompressed body lacks the asset metrics:\n%s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q without Accept-Encoding", got)
+	}
+	if !strings.Contains(rec.Body.String(), "collins_asset_status{") {
+		t.Errorf("plain body lacks the asset metrics:\n%s", rec.Body)
+	}
+}
+
+// metricValue returns the value of the given counter or gauge, or the sample
+// count of the given histogram.
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case pb.Counter != nil:
+		return pb.Counter.GetValue()
+	case pb.Gauge != nil:
+		return pb.Gauge.GetValue()
+	case pb.Histogram != nil:
+		return float64(pb.Histogram.GetSampleCount())
+	}
+	t.Fatalf("unsupported metric %s", m.Desc())
+	return 0
+}
+
+func TestBreakerSkipsScrapes(t *testing.T) {
+	finder := newFakeFinder(3)
+	finder.failPages = map[int]bool{0: true}
+	e, err := NewExporterWithFinder(Config{PageSize: 10, BreakerThreshold: 1, BreakerCooldown: time.Hour}, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.scrapeCollins()
+	e.scrapeCollins()
+	e.scrapeCollins()
+
+	if calls := finder.findCalls(); calls != 1 {
+		t.Errorf("got %d requests to Collins, want 1", calls)
+	}
+	for _, test := range []struct {
+		name string
+		m    prometheus.Metric
+		want float64
+	}{
+		{name: "scrapes_total", m: e.scrapesTotal, want: 1},
+		{name: "scrape_failures_total", m: e.scrapeFailures, want: 1},
+		{name: "scrapes_skipped_total", m: e.scrapesSkipped, want: 2},
+		{name: "scrape_latency_seconds", m: e.scrapeDurations, want: 1},
+		{name: "circuit_open", m: e.circuitOpen, want: 1},
+		{name: "up", m: e.up, want: 0},
+	} {
+		if got := metricValue(t, test.m); got != test.want {
+			t.Errorf("got %s %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConcurrentCollectsShareScrape(t *testing.T) {
+	finder := newFakeFinder(3)
+	finder.release = make(chan struct{})
+	// collect_waiters counts collections before Loop has received their
+	// request, so a collection might only reach Loop once the scrape is
+	// done. The cache TTL makes it get the result of the same scrape.
+	e, err := NewExporterWithFinder(Config{PageSize: 10, CacheTTL: time.Hour}, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+
+	const collectors = 50
+	var wg sync.WaitGroup
+	for i := 0; i < collectors; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collect(e.AssetCollector())
+		}()
+	}
+	// Only let the scrape finish once all collections wait for it.
+	deadline := time.Now().Add(10 * time.Second)
+	for metricValue(t, e.collectWaiters) < collectors {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %v of %d collections are waiting", metricValue(t, e.collectWaiters), collectors)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(finder.release)
+	wg.Wait()
+
+	if calls := finder.findCalls(); calls != 1 {
+		t.Errorf("got %d requests to Collins, want 1", calls)
+	}
+	if got := metricValue(t, e.scrapesTotal); got != 1 {
+		t.Errorf("got %v scrapes, want 1", got)
+	}
+}
+
+func TestPaginationModes(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		mode         string
+		assets       int
+		failQueries  map[string]bool
+		wantRequests []string
+		wantAssets   int
+		wantFailed   []int
+	}{
+		{
+			name:         "page",
+			mode:         paginationPage,
+			assets:       25,
+			wantRequests: []string{"0 TYPE = SERVER_NODE", "1 TYPE = SERVER_NODE", "2 TYPE = SERVER_NODE"},
+			wantAssets:   25,
+		},
+		{
+			name:         "cursor",
+			mode:         paginationCursor,
+			assets:       25,
+			wantRequests: []string{"0 TYPE = SERVER_NODE", "0 (TYPE = SERVER_NODE) AND ID = [11, *]", "0 (TYPE = SERVER_NODE) AND ID = [21, *]"},
+			wantAssets:   25,
+		},
+		{
+			// The total from the first page ends the scrape without
+			// requesting an empty page.
+			name:         "cursor with full last page",
+			mode:         paginationCursor,
+			assets:       20,
+			wantRequests: []string{"0 TYPE = SERVER_NODE", "0 (TYPE = SERVER_NODE) AND ID = [11, *]"},
+			wantAssets:   20,
+		},
+		{
+			// The pages following a failed one cannot be requested.
+			name:         "cursor with failed page",
+			mode:         paginationCursor,
+			assets:       35,
+			failQueries:  map[string]bool{"(TYPE = SERVER_NODE) AND ID = [11, *]": true},
+			wantRequests: []string{"0 TYPE = SERVER_NODE", "0 (TYPE = SERVER_NODE) AND ID = [11, *]"},
+			wantAssets:   10,
+			wantFailed:   []int{1},
+		},
+	} {
+		finder := newFakeFinder(test.assets)
+		finder.failQueries = test.failQueries
+		e, err := NewExporterWithFinder(Config{Query: "TYPE = SERVER_NODE", PageSize: 10, Concurrency: 1, PaginationMode: test.mode}, finder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := e.getAllAssets(context.Background(), time.Time{})
+		if (err != nil) != (test.wantFailed != nil) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if got, want := fmt.Sprint(result.failedPages), fmt.Sprint(test.wantFailed); got != want {
+			t.Errorf("%s: got failed pages %s, want %s", test.name, got, want)
+		}
+		if got := len(result.assets); got != test.wantAssets {
+			t.Errorf("%s: got %d assets, want %d", test.name, got, test.wantAssets)
+		}
+		for i, asset := range result.assets {
+			if asset.Metadata.ID != i+1 {
+				t.Errorf("%s: got asset %d at position %d", test.name, asset.Metadata.ID, i)
+				break
+			}
+		}
+		if got, want := fmt.Sprintf("%q", finder.requests), fmt.Sprintf("%q", test.wantRequests); got != want {
+			t.Errorf("%s: got requests %s, want %s", test.name, got, want)
+		}
+	}
+
+	if _, err := NewExporterWithFinder(Config{PageSize: 10, PaginationMode: "offset"}, newFakeFinder(0)); err == nil {
+		t.Error("expected error for unknown pagination mode")
+	}
+}
+
+func TestExporterWithFinder(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		assets       int
+		failPages    map[int]bool
+		allowPartial bool
+		wantTags     int
+		wantFailures float64
+	}{
+		{name: "single page", assets: 5, wantTags: 5},
+		{name: "multiple pages", assets: 25, wantTags: 25},
+		{name: "failed page", assets: 25, failPages: map[int]bool{2: true}, wantFailures: 1},
+		{name: "failed page with partial results", assets: 25, failPages: map[int]bool{1: true}, allowPartial: true, wantTags: 15},
+	} {
+		finder := newFakeFinder(test.assets)
+		finder.failPages = test.failPages
+		e, err := NewExporterWithFinder(Config{PageSize: 10, Concurrency: 2, AllowPartial: test.allowPartial}, finder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go e.Loop()
+		// A registry gathers its collectors concurrently, so the scrape
+		// metrics are only read once the asset metrics are gathered.
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(e.AssetCollector())
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		failures := metricValue(t, e.scrapeFailures)
+
+		tags := map[string]bool{}
+		for _, family := range families {
+			if family.GetName() != "collins_asset_status" {
+				continue
+			}
+			for _, m := range family.Metric {
+				if m.Gauge.GetValue() != 1 {
+					continue
+				}
+				for _, label := range m.Label {
+					if label.GetName() == "tag" {
+						tags[label.GetValue()] = true
+					}
+				}
+			}
+		}
+		if len(tags) != test.wantTags {
+			t.Errorf("%s: got %d assets with a status, want %d", test.name, len(tags), test.wantTags)
+		}
+		if failures != test.wantFailures {
+			t.Errorf("%s: got %v scrape failures, want %v", test.name, failures, test.wantFailures)
+		}
+	}
+}
+
+func TestScrapeJitterQueuesRequests(t *testing.T) {
+	const jitter = 100 * time.Millisecond
+	finder := newFakeFinder(3)
+	e, err := NewExporterWithFinder(Config{PageSize: 10, ScrapeInterval: time.Hour, ScrapeJitter: jitter}, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+
+	if n := len(collect(e.AssetCollector())); n == 0 {
+		t.Error("collection got no metrics")
+	}
+	// Give a second scrape, started once jitter fires, time to show up.
+	time.Sleep(jitter)
+	if calls := finder.findCalls(); calls != 1 {
+		t.Errorf("got %d requests to Collins, want 1", calls)
+	}
+}
+
+func TestSelfAndAssetMetricsDoNotOverlap(t *testing.T) {
+	e, err := NewExporterWithFinder(Config{PageSize: 10, FlagQuery: "STATUS = Maintenance"}, newFakeFinder(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+	assetRegistry, selfRegistry := prometheus.NewRegistry(), prometheus.NewRegistry()
+	assetRegistry.MustRegister(e.AssetCollector())
+	selfRegistry.MustRegister(e.SelfCollector())
+
+	assetFamilies, err := assetRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfFamilies, err := selfRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assetFamilies) == 0 || len(selfFamilies) == 0 {
+		t.Fatalf("got %d asset and %d self metric families, want both", len(assetFamilies), len(selfFamilies))
+	}
+	names := map[string]bool{}
+	for _, family := range assetFamilies {
+		names[family.GetName()] = true
+	}
+	for _, family := range selfFamilies {
+		if names[family.GetName()] {
+			t.Errorf("metric family %s is collected by both collectors", family.GetName())
+		}
+	}
+}
+
+func TestReloadClientsAllOrNothing(t *testing.T) {
+	good, err := NewExporterWithFinder(Config{
+		PageSize:    10,
+		Credentials: collinsCredentials{Host: "https://collins.example.com", Username: "user", Password: "secret"},
+	}, newFakeFinder(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := NewExporterWithFinder(Config{PageSize: 10, CollinsConfig: "/nonexistent/collins.yml"}, newFakeFinder(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadClients([]*Exporter{good, bad}); err == nil {
+		t.Fatal("expected error for missing Collins config")
+	}
+	if good.reloadedClient != nil {
+		t.Error("client swapped in although another Exporter failed to reload")
+	}
+	if err := reloadClients([]*Exporter{good}); err != nil {
+		t.Fatal(err)
+	}
+	if good.reloadedClient == nil {
+		t.Error("client not swapped in")
+	}
+}
+
+func TestAssetsUnknownStatus(t *testing.T) {
+	finder := newFakeFinder(3)
+	finder.assets[1].Metadata.Status = "Custom"
+	e, err := NewExporterWithFinder(Config{PageSize: 10}, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The gauge reflects the last scrape rather than adding up across
+	// scrapes.
+	for i := 0; i < 2; i++ {
+		if err := e.scrapeCollins(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range e.lastScrapeResult {
+		if strings.Contains(m.Desc().String(), `"collins_assets_unknown_status"`) {
+			if got := metricValue(t, m); got != 1 {
+				t.Errorf("got %v assets with an unknown status, want 1", got)
+			}
+			return
+		}
+	}
+	t.Error("collins_assets_unknown_status not exported")
+}
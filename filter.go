@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// filterHandler returns a handler serving the metrics of the given Exporters
+// restricted to the assets with the attributes given by the attr parameters
+// of the request. Each parameter has the form KEY:value. The asset metrics are
+// taken from the result of the Exporters' scrapes of Collins, so filtered
+// requests are subject to the same cache and merging of concurrent scrapes as
+// unfiltered ones. Requests without attr parameters are served by next.
+func filterHandler(next http.Handler, exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attrs := r.URL.Query()["attr"]
+		if len(attrs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		filters, err := parseAttributeFilters(attrs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The asset metrics are gathered first, so that the self-metrics
+		// reflect any scrape of Collins they initiated.
+		assetRegistry, selfRegistry := prometheus.NewRegistry(), prometheus.NewRegistry()
+		for _, e := range exporters {
+			assetRegistry.MustRegister(filteredCollector{e: e, filters: filters})
+			selfRegistry.MustRegister(e.SelfCollector())
+		}
+		gatherer := prometheus.Gatherers{assetRegistry, selfRegistry}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// parseAttributeFilters turns the given KEY:value pairs into a map from the
+// uppercased keys to the values.
+func parseAttributeFilters(attrs []string) (map[string]string, error) {
+	filters := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		parts := strings.SplitN(attr, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid attribute filter %q, must be KEY:value", attr)
+		}
+		key := strings.ToUpper(parts[0])
+		if value, ok := filters[key]; ok && value != parts[1] {
+			return nil, fmt.Errorf("conflicting attribute filters for %s", key)
+		}
+		filters[key] = parts[1]
+	}
+	return filters, nil
+}
+
+// filteredCollector collects the asset metrics of an Exporter through its Loop,
+// restricted to the assets with the attributes given by filters. Metrics
+// aggregated across assets are left out, as they do not reflect the filters.
+type filteredCollector struct {
+	e       *Exporter
+	filters map[string]string
+}
+
+// Describe implements prometheus.Collector.
+func (c filteredCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.describeAssetMetrics(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c filteredCollector) Collect(ch chan<- prometheus.Metric) {
+	result := c.e.result()
+	for _, metric := range result.metrics {
+		tag, err := metricTag(metric)
+		if err != nil {
+			log.Errorf("Could not filter metric %s: %s", metric.Desc(), err)
+			continue
+		}
+		if tag != "" && matchAttributes(result.attributes[tag], c.filters) {
+			ch <- metric
+		}
+	}
+}
+
+// metricTag returns the value of the tag label of the given metric, or the
+// empty string if it has none.
+func metricTag(metric prometheus.Metric) (string, error) {
+	var pb dto.Metric
+	if err := metric.Write(&pb); err != nil {
+		return "", err
+	}
+	for _, label := range pb.Label {
+		if label.GetName() == "tag" {
+			return label.GetValue(), nil
+		}
+	}
+	return "", nil
+}
+
+// matchAttributes returns whether the given attributes have the values of all
+// filters. Values are compared regardless of their case, like Collins does in
+// queries.
+func matchAttributes(attributes, filters map[string]string) bool {
+	for key, value := range filters {
+		if !strings.EqualFold(attributes[key], value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterHandler(t *testing.T) {
+	finder := newFakeFinder(4)
+	for i := range finder.assets {
+		pool := "web"
+		if i%2 == 1 {
+			pool = "db"
+		}
+		finder.assets[i].Attributes = map[string]map[string]string{"0": {"POOL": pool}}
+	}
+	// Within the cache TTL, all requests are served from a single scrape.
+	e, err := NewExporterWithFinder(Config{PageSize: 10, CacheTTL: time.Hour}, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unfiltered"))
+	})
+	handler := filterHandler(next, []*Exporter{e})
+
+	for _, test := range []struct {
+		query     string
+		want      int
+		contains  []string
+		forbidden []string
+	}{
+		{query: "", want: http.StatusOK, contains: []string{"unfiltered"}},
+		{
+			query:     "?attr=pool:WEB",
+			want:      http.StatusOK,
+			contains:  []string{`tag="tag001"`, `tag="tag003"`, "collins_up 1"},
+			forbidden: []string{`tag="tag002"`, `tag="tag004"`, "collins_assets_by_status"},
+		},
+		{
+			query:     "?attr=POOL:db&attr=DATACENTER:us-east",
+			want:      http.StatusOK,
+			forbidden: []string{`tag="`},
+		},
+		{query: "?attr=POOL", want: http.StatusBadRequest},
+		{query: "?attr=POOL:web&attr=POOL:db", want: http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics"+test.query, nil))
+		if rec.Code != test.want {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.want)
+			continue
+		}
+		body, _ := ioutil.ReadAll(rec.Body)
+		for _, s := range test.contains {
+			if !strings.Contains(string(body), s) {
+				t.Errorf("%q: body does not contain %s", test.query, s)
+			}
+		}
+		for _, s := range test.forbidden {
+			if strings.Contains(string(body), s) {
+				t.Errorf("%q: body contains %s", test.query, s)
+			}
+		}
+	}
+	if calls := finder.findCalls(); calls != 1 {
+		t.Errorf("got %d requests to Collins, want 1", calls)
+	}
+}
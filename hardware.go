@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+)
+
+// sizeUnits maps the units used in Collins human-readable size strings to
+// their size in bytes. Collins reports sizes in binary units, even where it
+// uses the decimal unit names.
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+	"TB":  1 << 40,
+	"TIB": 1 << 40,
+	"PB":  1 << 50,
+	"PIB": 1 << 50,
+}
+
+// parseSize converts a Collins human-readable size string like "16 GB",
+// "1.5TB" or "512" into bytes. A size without a unit is in bytes.
+func parseSize(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("malformed size %q", s)
+	}
+	unit := "B"
+	if rest := strings.TrimSpace(s[i:]); rest != "" {
+		unit = strings.ToUpper(rest)
+	}
+	factor, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in size %q", s)
+	}
+	return value * factor, nil
+}
+
+// memoryBytes returns the total memory installed in the given asset, summed
+// across all populated memory banks. The boolean result is false if the asset
+// has no usable memory information.
+func memoryBytes(asset collins.Asset) (float64, bool) {
+	var total float64
+	found := false
+	for _, memory := range asset.Memory {
+		if memory.SizeHuman == "" {
+			continue // Empty bank.
+		}
+		size, err := parseSize(memory.SizeHuman)
+		if err != nil {
+			log.Debugf("Ignoring memory bank %d of asset %s: %s", memory.Bank, asset.Metadata.Tag, err)
+			continue
+		}
+		total += size
+		found = true
+	}
+	return total, found
+}
+
+// ignoredDiskTypes are the Collins disk types that do not count towards an
+// asset's storage, like flash cache cards and optical drives.
+var ignoredDiskTypes = map[string]bool{
+	"FLASH":  true,
+	"CD-ROM": true,
+}
+
+// diskStats returns the number of disks installed in the given asset and their
+// total capacity in bytes. Disks of the ignoredDiskTypes are not counted. The
+// boolean result is false if the asset has no disk information at all.
+func diskStats(asset collins.Asset) (int, float64, bool) {
+	var (
+		count    int
+		capacity float64
+	)
+	for _, disk := range asset.Disks {
+		if ignoredDiskTypes[strings.ToUpper(disk.Type)] {
+			continue
+		}
+		count++
+		size, err := parseSize(disk.SizeHuman)
+		if err != nil {
+			log.Debugf("Ignoring size of disk %q of asset %s: %s", disk.Description, asset.Metadata.Tag, err)
+			continue
+		}
+		capacity += size
+	}
+	return count, capacity, len(asset.Disks) > 0
+}
+
+// getAllHardware retrieves the detailed representation of each of the given
+// assets from collins and fills in its hardware information, running at most
+// concurrency requests at a time. This requires one additional request per
+// asset. Assets whose retrieval fails are logged and left without hardware
+// information. getAllHardware returns the number of failed retrievals. Once ctx
+// is done, no further assets are retrieved.
+func getAllHardware(ctx context.Context, client *collins.Client, assets []collins.Asset, concurrency int) int {
+	var (
+		mtx      sync.Mutex
+		failures int
+	)
+	// Each call writes only to the asset it is retrieving, so only the
+	// failure count needs locking.
+	err := forEachAsset(ctx, assets, concurrency, func(asset *collins.Asset) {
+		detailed, _, err := client.Assets.Get(asset.Metadata.Tag)
+		if err != nil {
+			log.Errorf("Assets.Get for asset %s returned error: %s", asset.Metadata.Tag, err)
+			mtx.Lock()
+			failures++
+			mtx.Unlock()
+			return
+		}
+		asset.Hardware = detailed.Hardware
+	})
+	if err != nil {
+		log.Warnf("Stopped retrieving the hardware of assets: %s", err)
+	}
+	return failures
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "512 MB", want: 512 << 20},
+		{in: "16 GB", want: 16 << 30},
+		{in: "1.5 TB", want: 1.5 * (1 << 40)},
+		{in: "16 GiB", want: 16 << 30},
+		{in: "16 gb", want: 16 << 30},
+		{in: "16GB", want: 16 << 30},
+		{in: "16   GB", want: 16 << 30},
+		{in: "  16 GB  ", want: 16 << 30},
+		{in: "1024", want: 1024},
+		{in: "0 B", want: 0},
+		{in: "", wantErr: true},
+		{in: "GB", wantErr: true},
+		{in: "sixteen GB", wantErr: true},
+		{in: "16 XB", wantErr: true},
+		{in: "16 G B", wantErr: true},
+		{in: "1.2.3 GB", wantErr: true},
+		{in: "-16 GB", wantErr: true},
+	} {
+		got, err := parseSize(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSize(%q) returned error: %s", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseSize(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+)
+
+// probeAllIPMI checks whether the IPMI address of each of the given assets
+// accepts TCP connections on the given port, running at most concurrency
+// probes at a time. It returns a map from asset tag to whether the probe
+// succeeded within the timeout. Assets without an IPMI address are missing
+// from the map, as are those not probed because ctx is done.
+func probeAllIPMI(ctx context.Context, assets []collins.Asset, port int, timeout time.Duration, concurrency int) map[string]bool {
+	var (
+		mtx       sync.Mutex
+		reachable = make(map[string]bool, len(assets))
+		dialer    = net.Dialer{Timeout: timeout}
+	)
+	err := forEachAsset(ctx, assets, concurrency, func(asset *collins.Asset) {
+		tag, address := asset.Metadata.Tag, asset.IPMI.Address
+		if address == "" {
+			return
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+		if ctx.Err() != nil {
+			// The probe was cut short, so its result says nothing
+			// about the address.
+			return
+		}
+		if err != nil {
+			log.Debugf("IPMI address %s of asset %s is unreachable: %s", address, tag, err)
+		} else {
+			conn.Close()
+		}
+		mtx.Lock()
+		reachable[tag] = err == nil
+		mtx.Unlock()
+	})
+	if err != nil {
+		log.Warnf("Stopped probing the IPMI addresses of assets: %s", err)
+	}
+	return reachable
+}
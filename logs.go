@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+)
+
+// getAllLogSeverities retrieves the most recent logs of each of the given
+// assets from collins, running at most concurrency requests at a time. At
+// most limit logs are retrieved per asset, and if maxAge is positive, only logs
+// created within maxAge are considered. It returns a map from asset tag to the
+// number of logs per severity. Assets whose logs could not be retrieved are
+// missing from the map. Once ctx is done, no further logs are retrieved.
+func getAllLogSeverities(ctx context.Context, client *collins.Client, assets []collins.Asset, limit int, maxAge time.Duration, concurrency int) map[string]map[string]int {
+	var (
+		mtx        sync.Mutex
+		severities = make(map[string]map[string]int, len(assets))
+		now        = time.Now()
+	)
+	err := forEachAsset(ctx, assets, concurrency, func(asset *collins.Asset) {
+		tag := asset.Metadata.Tag
+		logs, _, err := client.Logs.Get(tag, &collins.LogGetOpts{
+			PageOpts: collins.PageOpts{Size: limit, Sort: "DESC"},
+		})
+		if err != nil {
+			log.Errorf("Logs.Get for asset %s returned error: %s", tag, err)
+			return
+		}
+
+		counts := map[string]int{}
+		for _, l := range logs {
+			if maxAge > 0 {
+				created, err := parseTimestamp(l.Created)
+				if err != nil || float64(now.UnixNano())/1e9-created > maxAge.Seconds() {
+					continue
+				}
+			}
+			counts[strings.ToUpper(l.Type)]++
+		}
+		mtx.Lock()
+		severities[tag] = counts
+		mtx.Unlock()
+	})
+	if err != nil {
+		log.Warnf("Stopped retrieving the logs of assets: %s", err)
+	}
+	return severities
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// tagMetrics creates the metrics about the tags defined in Collins. If the
+// tags cannot be listed, or ctx is done, no metrics are returned.
+func (e *Exporter) tagMetrics(ctx context.Context) []prometheus.Metric {
+	if ctx.Err() != nil {
+		log.Warnf("Not listing tags: %s", ctx.Err())
+		return nil
+	}
+	tags, _, err := e.client.Tags.List()
+	if err != nil {
+		log.Errorf("Tags.List returned error: %s", err)
+		return nil
+	}
+	return []prometheus.Metric{prometheus.MustNewConstMetric(
+		e.tagsTotalDesc,
+		prometheus.GaugeValue,
+		float64(len(tags)),
+	)}
+}
+
+// stateMetrics creates the metrics about the states defined in Collins. As
+// states rarely change, they are only listed again if the last list is older
+// than the state refresh interval. If the states cannot be listed, or ctx is
+// done, the last list is used.
+func (e *Exporter) stateMetrics(ctx context.Context) []prometheus.Metric {
+	if ctx.Err() != nil {
+		log.Warnf("Not listing states: %s", ctx.Err())
+	} else if e.states == nil || time.Since(e.statesUpdated) >= e.config.StateRefreshInterval {
+		states, _, err := e.client.States.List()
+		if err != nil {
+			log.Errorf("States.List returned error: %s", err)
+		} else {
+			e.states = states
+			e.statesUpdated = time.Now()
+		}
+	}
+
+	metrics := make([]prometheus.Metric, 0, len(e.states))
+	for _, state := range e.states {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			e.stateInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			strconv.Itoa(state.ID), state.Name, state.Label, state.Status.Name,
+		))
+	}
+	return metrics
+}
+
+// serverInfoMetrics creates the metrics about the Collins server. The client
+// library does not support the ping endpoint, so it is requested directly. If
+// the endpoint cannot be reached or does not report a version, no metrics are
+// returned. The request is cancelled once ctx is done.
+func (e *Exporter) serverInfoMetrics(ctx context.Context) []prometheus.Metric {
+	req, err := e.client.NewRequest("GET", "api/ping")
+	if err != nil {
+		log.Errorf("Could not create ping request: %s", err)
+		return nil
+	}
+	req = req.WithContext(ctx)
+	// Depending on the Collins version, the version is reported at the top
+	// level or in the data object.
+	var ping struct {
+		Version string
+		Data    struct {
+			Version string
+		}
+	}
+	if _, err := e.client.Do(req, &ping); err != nil {
+		log.Errorf("Ping returned error: %s", err)
+		return nil
+	}
+	version := ping.Version
+	if version == "" {
+		version = ping.Data.Version
+	}
+	if version == "" {
+		log.Debugln("Ping response does not contain a version")
+		return nil
+	}
+	return []prometheus.Metric{prometheus.MustNewConstMetric(
+		e.serverInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		version,
+	)}
+}
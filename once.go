@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/version"
+)
+
+// scrapeOnce scrapes Collins once with each of the given exporters and writes
+// the results in the Prometheus text format to w. It returns whether all
+// scrapes succeeded. The exporters must not be running their Loop.
+func scrapeOnce(w io.Writer, exporters []*Exporter) (bool, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(version.NewCollector("collins_exporter"))
+	ok := true
+	for _, e := range exporters {
+		if err := e.scrapeCollins(); err != nil {
+			ok = false
+		}
+		registry.MustRegister(e.SelfCollector(), lastResultCollector{e})
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return false, err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return false, err
+		}
+	}
+	return ok, nil
+}
+
+// lastResultCollector collects the asset metrics from the last scrape of an
+// Exporter without starting a new one, unlike the collector returned by
+// AssetCollector, which goes through the Exporter's Loop.
+type lastResultCollector struct {
+	e *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (c lastResultCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.describeAssetMetrics(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c lastResultCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c.e.lastScrapeResult {
+		ch <- metric
+	}
+}
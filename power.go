@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/tumblr/go-collins.v0/collins"
+)
+
+// getAllPowerStatus queries collins for the power status of each of the given
+// assets, running at most concurrency queries at a time. It returns a map from
+// asset tag to whether the asset is powered on. Assets whose power status
+// could not be determined are missing from the map. Once ctx is done, no
+// further assets are queried.
+func getAllPowerStatus(ctx context.Context, client *collins.Client, assets []collins.Asset, concurrency int) map[string]bool {
+	var (
+		mtx     sync.Mutex
+		powerOn = make(map[string]bool, len(assets))
+	)
+	err := forEachAsset(ctx, assets, concurrency, func(asset *collins.Asset) {
+		tag := asset.Metadata.Tag
+		status, _, err := client.Management.PowerStatus(tag)
+		if err != nil {
+			log.Errorf("Management.PowerStatus for asset %s returned error: %s", tag, err)
+			return
+		}
+
+		var on bool
+		switch strings.ToLower(status) {
+		case "on":
+			on = true
+		case "off":
+			on = false
+		default:
+			log.Debugf("Unknown power status %q for asset %s", status, tag)
+			return
+		}
+		mtx.Lock()
+		powerOn[tag] = on
+		mtx.Unlock()
+	})
+	if err != nil {
+		log.Warnf("Stopped querying the power status of assets: %s", err)
+	}
+	return powerOn
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newProbeExporters returns an Exporter for each of the given targets, which
+// are Collins config files or URLs, see newCollinsClient. All other settings
+// are taken from the given config. The Loops of the Exporters must be running
+// to probe them.
+func newProbeExporters(config Config, targets []string) (map[string]*Exporter, error) {
+	exporters := make(map[string]*Exporter, len(targets))
+	for _, target := range targets {
+		if _, ok := exporters[target]; ok {
+			return nil, fmt.Errorf("probe target %s given more than once", redactURL(target))
+		}
+		config := config
+		config.CollinsConfig = target
+		// The target replaces any Collins instance given on the command
+		// line.
+		config.Credentials = collinsCredentials{}
+		e, err := NewExporter(config)
+		if err != nil {
+			return nil, fmt.Errorf("probe target %s: %s", redactURL(target), err)
+		}
+		exporters[target] = e
+	}
+	return exporters, nil
+}
+
+// probeHandler returns a handler serving the metrics of the Exporter for the
+// target parameter of each request. Only the targets of the given Exporters
+// can be probed. As the Exporters are long-lived, probes are subject to their
+// cache, circuit breaker, and merging of concurrent scrapes just like scrapes
+// of the metrics endpoint. At most concurrency probes are served at a time,
+// further ones wait for their turn.
+func probeHandler(exporters map[string]*Exporter, concurrency int) http.Handler {
+	sem := make(chan struct{}, concurrency)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		e, ok := exporters[target]
+		if !ok {
+			// The target is not echoed, as it might contain credentials.
+			http.Error(w, "Target is not one of the configured probe targets", http.StatusBadRequest)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-r.Context().Done():
+			return
+		}
+		// The asset metrics are gathered first, so that the self-metrics
+		// reflect any scrape of Collins they initiated.
+		assetRegistry, selfRegistry := prometheus.NewRegistry(), prometheus.NewRegistry()
+		assetRegistry.MustRegister(e.AssetCollector())
+		selfRegistry.MustRegister(e.SelfCollector())
+		gatherer := prometheus.Gatherers{assetRegistry, selfRegistry}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
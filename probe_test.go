@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProbeHandler(t *testing.T) {
+	e, err := NewExporterWithFinder(Config{PageSize: 10}, newFakeFinder(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Loop()
+	handler := probeHandler(map[string]*Exporter{"/etc/collins/us-east.yml": e}, 1)
+
+	for _, test := range []struct {
+		name     string
+		target   string
+		want     int
+		wantBody string
+	}{
+		{name: "configured target", target: "/etc/collins/us-east.yml", want: http.StatusOK, wantBody: "collins_up 1"},
+		{name: "other target", target: "https://collins.example.com", want: http.StatusBadRequest},
+		{name: "missing target", want: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(test.target), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, rec.Code, test.want)
+			continue
+		}
+		body, _ := ioutil.ReadAll(rec.Body)
+		if !strings.Contains(string(body), test.wantBody) {
+			t.Errorf("%s: body does not contain %q:\n%s", test.name, test.wantBody, body)
+		}
+	}
+}
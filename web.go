@@ -0,0 +1,256 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the configuration of the exporter's HTTP server. Its format
+// follows the web configuration file of the Prometheus exporter-toolkit, so
+// that the same files can be used across exporters.
+type webConfig struct {
+	TLSServerConfig struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+	} `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// loadWebConfig reads and validates the web configuration from the given file.
+func loadWebConfig(file string) (*webConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config webConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", file, err)
+	}
+	tls := config.TLSServerConfig
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return nil, errors.New("both cert_file and key_file must be set in tls_server_config")
+	}
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %q in basic_auth_users: %s", user, err)
+		}
+	}
+	return &config, nil
+}
+
+// basicAuthHandler wraps next with HTTP basic authentication of the given
+// users, which map user names to bcrypt hashes of their passwords.
+func basicAuthHandler(users map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			hash, known := users[user]
+			if !known {
+				// Compare against a dummy hash anyway, so that the response
+				// time does not reveal which users exist.
+				hash = unknownUserHash
+			}
+			err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+			if err == nil && known {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="collins_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// unknownUserHash is a bcrypt hash of no particular password, compared
+// against for unknown users.
+const unknownUserHash = "$2a$10$xtpjjkggig7e2eN6WZBBKemBojOFvvo4tKAjkxK.3zEz65kFwnhAG"
+
+// gzipHandler wraps next with gzip compression of the response body if the
+// request accepts it. The metrics handlers compress their responses
+// themselves and must not be wrapped.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next.ServeHTTP(gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	})
+}
+
+// acceptsGzip returns whether the Accept-Encoding header of r contains gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter is an http.ResponseWriter writing the response body to
+// a gzip.Writer.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// listen listens on the given address, which is either a TCP address or the
+// path of a Unix socket prefixed with "unix:". A stale socket left behind by a
+// previous process, i.e. one refusing connections, is replaced, while a socket
+// another process is listening on is an error. The socket is removed when the
+// listener is closed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		if !connRefused(err) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Allow the owner and the group to connect, e.g. a scraping agent
+	// sharing the group.
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// connRefused returns whether err is the error of a dial refused by the other
+// end.
+func connRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNREFUSED
+}
+
+// endpoint is an address to serve HTTP requests on with the given handler.
+type endpoint struct {
+	address string
+	handler http.Handler
+}
+
+// listenAndServe serves HTTP requests on each of the given endpoints, see
+// listen for their addresses, until the process receives SIGTERM or SIGINT or
+// one of the servers fails. If configFile is not empty, the web configuration
+// is read from it, and TLS is used on all endpoints if the configuration
+// contains a certificate, as is basic authentication if it contains users.
+// Otherwise, plain HTTP is served. Upon a signal,
+// in-flight requests are given up to gracePeriod to complete on all endpoints.
+// Scrapes of Collins are not drained, only requests waiting for them.
+func listenAndServe(endpoints []endpoint, configFile string, gracePeriod time.Duration) error {
+	var (
+		tls   struct{ certFile, keyFile string }
+		users map[string]string
+	)
+	if configFile != "" {
+		config, err := loadWebConfig(configFile)
+		if err != nil {
+			return err
+		}
+		tls.certFile = config.TLSServerConfig.CertFile
+		tls.keyFile = config.TLSServerConfig.KeyFile
+		users = config.BasicAuthUsers
+	}
+
+	// All listeners are set up before serving, so that a failing address
+	// does not leave the others serving.
+	listeners := make([]net.Listener, 0, len(endpoints))
+	for _, ep := range endpoints {
+		listener, err := listen(ep.address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	servers := make([]*http.Server, len(endpoints))
+	errCh := make(chan error, len(endpoints))
+	for i, ep := range endpoints {
+		handler := ep.handler
+		if len(users) > 0 {
+			handler = basicAuthHandler(users, handler)
+		}
+		servers[i] = &http.Server{Handler: handler}
+		go func(server *http.Server, listener net.Listener) {
+			if tls.certFile != "" {
+				errCh <- server.ServeTLS(listener, tls.certFile, tls.keyFile)
+			} else {
+				errCh <- server.Serve(listener)
+			}
+		}(servers[i], listeners[i])
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+		log.Errorf("Server failed, shutting down within %v: %s", gracePeriod, serveErr)
+	case sig := <-sigCh:
+		log.Infof("Received %s, shutting down within %v", sig, gracePeriod)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	shutdownErrs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			shutdownErrs <- server.Shutdown(ctx)
+		}(server)
+	}
+	for range servers {
+		if err := <-shutdownErrs; err != nil && serveErr == nil {
+			serveErr = fmt.Errorf("graceful shutdown failed: %s", err)
+		}
+	}
+	if serveErr != nil {
+		return serveErr
+	}
+	log.Infoln("Shutdown complete")
+	return nil
+}
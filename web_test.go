@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := basicAuthHandler(map[string]string{"alice": string(hash)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for _, test := range []struct {
+		name           string
+		user, password string
+		noAuth         bool
+		want           int
+	}{
+		{name: "valid", user: "alice", password: "secret", want: http.StatusOK},
+		{name: "wrong password", user: "alice", password: "wrong", want: http.StatusUnauthorized},
+		{name: "unknown user", user: "bob", password: "secret", want: http.StatusUnauthorized},
+		{name: "no credentials", noAuth: true, want: http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if !test.noAuth {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, rec.Code, test.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestLoadWebConfigBasicAuthUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collins_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name:   "bcrypt hash",
+			config: "basic_auth_users:\n  alice: $2a$10$iE3YUuhdLmfiL8Ez1JL2peRHY3ChgE.rnWoaeL/ynz3Qhi7GS18Lu\n",
+		},
+		{
+			name:    "plain text password",
+			config:  "basic_auth_users:\n  alice: secret\n",
+			wantErr: true,
+		},
+	} {
+		file := filepath.Join(dir, "web.yml")
+		if err := ioutil.WriteFile(file, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadWebConfig(file)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if len(config.BasicAuthUsers) != 1 {
+			t.Errorf("%s: got %d users, want 1", test.name, len(config.BasicAuthUsers))
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collins_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := "unix:" + filepath.Join(dir, "collins_exporter.sock")
+
+	listener, err := listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(address); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("got error %v for a socket in use, want address already in use", err)
+	}
+
+	// Leave the socket behind like a crashed process.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listen(address)
+	if err != nil {
+		t.Fatalf("could not replace stale socket: %s", err)
+	}
+	listener.Close()
+}